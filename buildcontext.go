@@ -0,0 +1,249 @@
+package project
+
+import (
+	"archive/tar"
+	"bufio"
+	. "github.com/ar90n/code-code-server/dockerfile"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// ignorePattern is a compiled line of .dockerignore.
+type ignorePattern struct {
+	pattern   *regexp.Regexp
+	exclusion bool
+}
+
+// dockerignore decides which files of the build context are sent to docker as .dockerignore does.
+type dockerignore struct {
+	patterns      []ignorePattern
+	hasExclusions bool
+}
+
+// defaultIgnorePatterns exclude version control and dependency directories, which are rarely needed by the
+// build but can make the build context huge, when the build context has no .dockerignore.
+var defaultIgnorePatterns = []string{
+	".git",
+	".hg",
+	".svn",
+	"**/node_modules",
+	"**/__pycache__",
+	".venv",
+}
+
+// readDockerignore reads .dockerignore of the build context. defaults are used if it does not exist.
+func readDockerignore(contextDirPath string, defaults []string) (dockerignore, error) {
+	f, err := os.Open(filepath.Join(contextDirPath, ".dockerignore"))
+	if os.IsNotExist(err) {
+		return parseDockerignore(defaults), nil
+	}
+	if err != nil {
+		return dockerignore{}, err
+	}
+	defer f.Close()
+
+	lines := []string{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		lines = append(lines, scanner.Text())
+	}
+	if err := scanner.Err(); err != nil {
+		return dockerignore{}, err
+	}
+	return parseDockerignore(lines), nil
+}
+
+func parseDockerignore(lines []string) dockerignore {
+	ignore := dockerignore{}
+	for _, line := range lines {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		exclusion := strings.HasPrefix(line, "!")
+		if exclusion {
+			line = strings.TrimSpace(line[1:])
+			ignore.hasExclusions = true
+		}
+		line = strings.TrimPrefix(path.Clean("/"+filepath.ToSlash(line)), "/")
+		ignore.patterns = append(ignore.patterns, ignorePattern{pattern: compileIgnorePattern(line), exclusion: exclusion})
+	}
+	return ignore
+}
+
+// compileIgnorePattern translates a .dockerignore pattern into a regexp. In addition to filepath.Match,
+// ** matches any number of directories.
+func compileIgnorePattern(pattern string) *regexp.Regexp {
+	var expr strings.Builder
+	expr.WriteString("^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case c == '*' && i+1 < len(pattern) && pattern[i+1] == '*':
+			i++
+			if i+1 < len(pattern) && pattern[i+1] == '/' {
+				i++
+				expr.WriteString("(.*/)?")
+			} else {
+				expr.WriteString(".*")
+			}
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				expr.WriteString(regexp.QuoteMeta(pattern[i:]))
+				i = len(pattern)
+				break
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	// a pattern matching a directory also matches everything in it
+	expr.WriteString("(/.*)?$")
+	return regexp.MustCompile(expr.String())
+}
+
+// ignores reports whether the slash separated path relative to the build context is excluded.
+// The last matching pattern wins.
+func (d *dockerignore) ignores(relPath string) bool {
+	ignored := false
+	for _, v := range d.patterns {
+		if v.pattern.MatchString(relPath) {
+			ignored = !v.exclusion
+		}
+	}
+	return ignored
+}
+
+// writeBuildContext writes the build context as a tar stream. It holds the files of contextDirPath
+// which are not ignored by .dockerignore or defaultIgnore in its absence, and the Dockerfile and the
+// generated files in GeneratedDir.
+func writeBuildContext(w io.Writer, contextDirPath string, defaultIgnore []string, dockerfile string, files GeneratedFiles) error {
+	ignore, err := readDockerignore(contextDirPath, defaultIgnore)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	err = filepath.Walk(contextDirPath, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		relPath, err := filepath.Rel(contextDirPath, filePath)
+		if err != nil {
+			return err
+		}
+		relPath = filepath.ToSlash(relPath)
+		if relPath == "." || relPath == GeneratedDir || strings.HasPrefix(relPath, GeneratedDir+"/") {
+			return nil
+		}
+		if relPath == ".dockerignore" {
+			// it is replaced below so that docker does not exclude the generated files
+			return nil
+		}
+		if ignore.ignores(relPath) {
+			// an exclusion may bring back a file in the directory, so it is walked in that case
+			if info.IsDir() && !ignore.hasExclusions {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return addFileToTar(tw, filePath, relPath, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	generated := map[string]GeneratedFile{path.Join(GeneratedDir, "Dockerfile"): {Contents: dockerfile}}
+	for name, file := range files {
+		generated[path.Join(GeneratedDir, name)] = file
+	}
+	// the files are already filtered, and the generated ones must not be excluded by docker
+	generated[".dockerignore"] = GeneratedFile{}
+	names := []string{}
+	for name := range generated {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		file := generated[name]
+		if file.HostPath != "" {
+			info, err := os.Stat(file.HostPath)
+			if err != nil {
+				return err
+			}
+			if err := addFileToTar(tw, file.HostPath, name, info); err != nil {
+				return err
+			}
+			continue
+		}
+		header := &tar.Header{Name: name, Mode: 0644, Size: int64(len(file.Contents))}
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if _, err := io.WriteString(tw, file.Contents); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+func addFileToTar(tw *tar.Writer, filePath string, relPath string, info os.FileInfo) error {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		var err error
+		if link, err = os.Readlink(filePath); err != nil {
+			return err
+		}
+	}
+	header, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return err
+	}
+	header.Name = relPath
+	if info.IsDir() {
+		header.Name += "/"
+	}
+	if err := tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return nil
+	}
+
+	f, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(tw, f)
+	return err
+}
+
+// newBuildContextReader streams the build context tar written by writeBuildContext.
+func newBuildContextReader(contextDirPath string, defaultIgnore []string, dockerfile string, files GeneratedFiles) io.ReadCloser {
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeBuildContext(w, contextDirPath, defaultIgnore, dockerfile, files))
+	}()
+	return r
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"runtime"
+)
+
+func getBrowserCommand(url string) (string, []string) {
+	switch runtime.GOOS {
+	case "darwin":
+		return "open", []string{url}
+	case "windows":
+		return "rundll32", []string{"url.dll,FileProtocolHandler", url}
+	default:
+		return "xdg-open", []string{url}
+	}
+}
+
+func isHeadless() bool {
+	if runtime.GOOS == "darwin" || runtime.GOOS == "windows" {
+		return false
+	}
+	return os.Getenv("DISPLAY") == "" && os.Getenv("WAYLAND_DISPLAY") == ""
+}
+
+func openBrowser(url string) error {
+	if isHeadless() {
+		return fmt.Errorf("No display found, skip opening %s", url)
+	}
+
+	name, args := getBrowserCommand(url)
+	if _, err := exec.LookPath(name); err != nil {
+		return fmt.Errorf("%s not found, skip opening %s", name, url)
+	}
+	return exec.Command(name, args...).Start()
+}
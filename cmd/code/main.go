@@ -1,78 +1,667 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
 	"os"
-	"path/filepath"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"time"
 
 	project "github.com/ar90n/code-code-server"
-	"github.com/ar90n/code-code-server/devcontainer"
+	"github.com/ar90n/code-code-server/dockerfile"
 	"github.com/ar90n/code-code-server/settings/gist"
 	"github.com/urfave/cli/v2"
 )
 
-func prettyUrlPrint(url project.ServiceURL) {
+func prettyUrlPrint(url project.ServiceURL, ports []project.ForwardedPort) {
 	log.Printf("==============================================================================================")
 	log.Printf("Code Server running at %s", url.String())
+	for _, port := range ports {
+		description := port.Port
+		if port.Label != "" {
+			description = fmt.Sprintf("%s (%s)", port.Port, port.Label)
+		}
+		if portURL := port.URL(url.Host); portURL != "" {
+			log.Printf("Forwarded port %s at %s", description, portURL)
+		} else {
+			log.Printf("Forwarded port %s", description)
+		}
+	}
 	log.Printf("==============================================================================================")
 }
 
+type urlOutput struct {
+	URL       string `json:"url"`
+	Host      string `json:"host"`
+	Port      int    `json:"port"`
+	Container string `json:"container"`
+}
+
+// printURL prints the URL as JSON with --json, bare with --quiet and as a banner otherwise.
+func printURL(c *cli.Context, url project.ServiceURL, ports []project.ForwardedPort, containerName string) {
+	switch {
+	case c.Bool("json"):
+		json.NewEncoder(os.Stdout).Encode(urlOutput{URL: url.String(), Host: url.Host, Port: url.Port, Container: containerName})
+	case c.Bool("quiet"):
+		fmt.Println(url.String())
+	default:
+		prettyUrlPrint(url, ports)
+	}
+}
+
+type event struct {
+	Event string `json:"event"`
+	URL   string `json:"url"`
+}
+
+func emitEvent(name string, url project.ServiceURL) {
+	json.NewEncoder(os.Stdout).Encode(event{Event: name, URL: url.String()})
+}
+
+func onReady(c *cli.Context, url project.ServiceURL, ports []project.ForwardedPort, containerName string) {
+	ctx, cancel := context.WithTimeout(context.Background(), c.Duration("ready-timeout"))
+	defer cancel()
+	err := url.WaitReady(ctx)
+	// the host ports are known once the container runs
+	ports = project.ResolveForwardedPorts(containerName, ports)
+	if err != nil {
+		log.Print(err)
+		printURL(c, url, ports, containerName)
+		return
+	}
+
+	printURL(c, url, ports, containerName)
+	if c.Bool("emit-events") {
+		emitEvent("ready", url)
+	}
+	if c.Bool("open") {
+		if err := openBrowser(url.String()); err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// splitArgs returns the project directory and the args following it and an optional "--".
+// The project directory is optional with a config file, so the args may start with docker run args then.
+func splitArgs(args []string, hasConfigFile bool) (string, []string) {
+	if len(args) == 0 {
+		return "", nil
+	}
+	projectDirPath, extraArgs := args[0], args[1:]
+	if hasConfigFile && strings.HasPrefix(projectDirPath, "-") {
+		projectDirPath, extraArgs = "", args
+	}
+	if 0 < len(extraArgs) && extraArgs[0] == "--" {
+		extraArgs = extraArgs[1:]
+	}
+	if len(extraArgs) == 0 {
+		return projectDirPath, nil
+	}
+	return projectDirPath, extraArgs
+}
+
+// findDevContainerJson returns the path of devcontainer.json given by the config file option or
+// found in the project directory, and the project directory given along with the config file.
+func findDevContainerJson(args []string, configFilePath string) (string, string, error) {
+	projectDirPath, _ := splitArgs(args, configFilePath != "")
+	if projectDirPath != "" {
+		if _, err := os.Stat(projectDirPath); os.IsNotExist(err) {
+			return "", "", fmt.Errorf("Project directory does not exist")
+		}
+	}
+
+	if configFilePath != "" {
+		if info, err := os.Stat(configFilePath); err != nil || info.IsDir() {
+			return "", "", fmt.Errorf("Config file %s does not exist", configFilePath)
+		}
+		return configFilePath, projectDirPath, nil
+	}
+
+	if projectDirPath == "" {
+		return "", "", fmt.Errorf("Please provide a project directory")
+	}
+	devcontainerJsonPath, ok := project.FindDevContainerJson(projectDirPath)
+	if !ok {
+		return "", "", fmt.Errorf("Project directory does not contain .devcontainer/devcontainer.json or .devcontainer.json. Run `code init %s` to create one", projectDirPath)
+	}
+	return devcontainerJsonPath, "", nil
+}
+
+// checkDocker fails early when the engine command is missing or cannot reach the daemon,
+// as every command shells out to it.
+func checkDocker() error {
+	notAvailable := "Docker is not installed or the daemon is not running"
+	if project.Engine() == project.Podman {
+		notAvailable = "Podman is not installed or cannot run containers"
+	}
+	if _, err := exec.LookPath(project.EngineBinary()); err != nil {
+		return fmt.Errorf("%s. %s is not found in PATH", notAvailable, project.EngineBinary())
+	}
+	if out, err := exec.Command(project.EngineBinary(), "info").CombinedOutput(); err != nil {
+		return fmt.Errorf("%s. Failed to connect to %s: %s", notAvailable, project.DockerDaemon(), bytes.TrimSpace(out))
+	}
+	return nil
+}
+
+// setProxy sets the proxy environment variables, which are used by the settings fetch and passed to the build.
+func setProxy(proxy string) error {
+	if proxy == "" {
+		return nil
+	}
+	for _, k := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy"} {
+		if err := os.Setenv(k, proxy); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// newBuildContext returns a context which is cancelled by a signal or the timeout.
+// A zero timeout means no timeout.
+func newBuildContext(timeout time.Duration) (context.Context, context.CancelFunc) {
+	ctx, stop := signal.NotifyContext(context.Background(), project.ShutdownSignals()...)
+	if timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+func newOptions(c *cli.Context) project.Options {
+	options := project.Options{
+		MountConsistency: c.String("mount-consistency"),
+		UpdateRemoteUID:  c.Bool("update-remote-uid"),
+		StopTimeout:      c.Duration("stop-timeout"),
+		Network:          c.String("network"),
+		Host:             c.String("host"),
+		Interface:        c.String("interface"),
+		BindAddr:         c.String("bind-addr"),
+		Quiet:            c.Bool("quiet"),
+		BuildKit:         c.Bool("buildkit"),
+		NoBuildKit:       c.Bool("no-buildkit"),
+		Sidecars:         c.StringSlice("with"),
+		EnvFiles:         c.StringSlice("env-file"),
+		Persist:          c.Bool("persist"),
+		BuildRetries:     c.Int("build-retries"),
+		Gpus:             c.String("gpus"),
+		ContextDir:       c.String("context-dir"),
+		Platform:         c.String("platform"),
+		ImageTag:         c.String("image-tag"),
+		Name:             c.String("name"),
+		Secrets:          c.StringSlice("secret"),
+		WorkspaceFolder:  c.String("workspace-folder"),
+		SELinuxLabel:     c.String("selinux-label"),
+		RemoveImage:      c.Bool("rm-image"),
+		Keep:             c.Bool("keep"),
+		NoWorkspaceMount: !c.Bool("mount-workspace"),
+		BuildArgs:        c.StringSlice("build-arg"),
+		NoDefaultIgnore:  c.Bool("no-default-ignore"),
+	}
+	options.Locale = c.String("locale")
+	options.IgnoreExtensionErrors = !c.Bool("fail-on-extension-error")
+	options.CreateRemoteUser = c.Bool("create-remote-user")
+	options.UserDataDir = c.String("user-data-dir")
+	options.ExtensionsDir = c.String("extensions-dir")
+	options.PreferLocalSettings = c.Bool("prefer-local-settings")
+	options.StrictLifecycle = c.Bool("strict-lifecycle")
+	options.Extensions = c.StringSlice("extension")
+	options.NoExtensions = c.Bool("no-extensions")
+	options.NoProjectSettings = c.Bool("no-project-settings")
+	options.NoSettings = c.Bool("no-settings")
+	options.NoKeybindings = c.Bool("no-keybindings")
+	options.CodeServerInstall = c.String("code-server-install")
+	options.CloneRepository = c.String("clone")
+	options.EntrypointShell = c.String("entrypoint-shell")
+	_, options.ExtraRunArgs = splitArgs(c.Args().Slice(), c.String("config-file") != "")
+	return options
+}
+
 func main() {
 	app := &cli.App{
 		Name:    "code",
-		Version: "0.1.0",
+		Version: project.Version,
 		Usage:   "code",
+		// everything after the project directory is passed to docker run
+		ArgsUsage: "<project-dir> [-- docker-run-args...]. The project dir is optional with --config-file",
+		Before: func(c *cli.Context) error {
+			project.SetEngineBinary(c.String("docker-bin"))
+			return project.SetEngine(c.String("engine"))
+		},
+		Flags: []cli.Flag{
+			&cli.StringFlag{
+				Name:  "engine",
+				Usage: "container engine, docker or podman. It defaults to the one installed, preferring docker",
+			},
+			&cli.StringFlag{
+				Name:    "docker-bin",
+				Usage:   "path of the engine command such as /usr/bin/docker.io. It defaults to the engine name in PATH",
+				EnvVars: []string{"DOCKER_BIN"},
+			},
+			&cli.BoolFlag{
+				Name:    "quiet",
+				Aliases: []string{"q"},
+				Usage:   "suppress the docker build output unless the build fails and print only the URL",
+			},
+			&cli.StringFlag{
+				Name:  "config-file",
+				Usage: "path of devcontainer.json to use instead of the one found in the project directory",
+			},
+			&cli.BoolFlag{
+				Name:  "json",
+				Usage: "print the URL, host, port and container name as JSON instead of the banner",
+			},
+			&cli.DurationFlag{
+				Name:  "build-timeout",
+				Usage: "abort the docker build when it takes longer than this. 0 means no timeout",
+			},
+			&cli.StringFlag{
+				Name:  "image-tag",
+				Usage: "tag of the built image. It defaults to one derived from the name in devcontainer.json",
+			},
+			&cli.StringFlag{
+				Name:  "name",
+				Usage: "name of the container. It defaults to a random one",
+			},
+			&cli.StringFlag{
+				Name:  "platform",
+				Usage: "platform of the image and the container such as linux/amd64. It overrides build.platform in devcontainer.json",
+			},
+			&cli.StringFlag{
+				Name:  "workspace-folder",
+				Usage: "absolute path in the container which Code Server opens. It overrides workspaceFolder in devcontainer.json but not where the workspace is mounted",
+			},
+			&cli.StringFlag{
+				Name:  "context-dir",
+				Usage: "build context directory. It overrides build.context in devcontainer.json",
+			},
+			&cli.IntFlag{
+				Name:  "build-retries",
+				Usage: "retry the docker build up to this many times when it fails with a transient network error",
+			},
+			&cli.BoolFlag{
+				Name:  "buildkit",
+				Usage: "build with BuildKit. It is enabled automatically when the Dockerfile has a syntax directive or RUN --mount",
+			},
+			&cli.BoolFlag{
+				Name:  "no-buildkit",
+				Usage: "build without BuildKit",
+			},
+			&cli.BoolFlag{
+				Name:  "no-default-ignore",
+				Usage: "send .git, node_modules and the like in the build context when the project has no .dockerignore",
+			},
+			&cli.StringSliceFlag{
+				Name:  "build-arg",
+				Usage: "pass a build arg such as VERSION=1.18 to the build, overriding build.args in devcontainer.json",
+			},
+			&cli.StringSliceFlag{
+				Name:  "secret",
+				Usage: "expose a file to the docker build as a secret such as id=npm,src=$HOME/.npmrc. It requires BuildKit",
+			},
+			&cli.StringFlag{
+				Name:  "build-log",
+				Usage: "write the docker build output to the file",
+			},
+			&cli.StringFlag{
+				Name:  "proxy",
+				Usage: "HTTP proxy such as http://proxy.example.com:3128 for fetching the settings and building the image. It overrides HTTP_PROXY and HTTPS_PROXY",
+			},
+			&cli.StringFlag{
+				Name:  "mount-consistency",
+				Usage: "consistency of the workspace bind mount (consistent, cached or delegated)",
+			},
+			&cli.StringFlag{
+				Name:  "selinux-label",
+				Usage: "relabel bind mounts for SELinux with z (shared) or Z (private), or none. It defaults to z when SELinux is enforcing",
+			},
+			&cli.StringFlag{
+				Name:  "bind-addr",
+				Usage: "host address Code Server is published on. 127.0.0.1 is recommended on shared networks",
+				Value: "0.0.0.0",
+			},
+			&cli.StringFlag{
+				Name:  "host",
+				Usage: "host name or IP address shown in the Code Server URL",
+			},
+			&cli.StringFlag{
+				Name:  "interface",
+				Usage: "network interface whose address is shown in the Code Server URL",
+			},
+			&cli.StringFlag{
+				Name:  "network",
+				Usage: "docker network to connect the container to",
+			},
+			&cli.StringSliceFlag{
+				Name:  "env-file",
+				Usage: "read environment variables of the container from the file. Variables in runArgs take precedence",
+			},
+			&cli.BoolFlag{
+				Name:  "persist",
+				Usage: "keep the Code Server state such as extension state and open editors in volumes of the project",
+			},
+			&cli.BoolFlag{
+				Name:  "mount-workspace",
+				Usage: "mount the project directory on the workspace folder. --mount-workspace=false leaves it in the container",
+				Value: true,
+			},
+			&cli.StringFlag{
+				Name:  "clone",
+				Usage: "clone the repository into the workspace folder kept in a volume of the project. It requires --mount-workspace=false",
+			},
+			&cli.BoolFlag{
+				Name:  "keep",
+				Usage: "keep the container after it stops to inspect it with docker logs. Remove it with docker rm",
+			},
+			&cli.BoolFlag{
+				Name:  "rm-image",
+				Usage: "remove the built image after the container stops unless another container uses it",
+			},
+			&cli.StringSliceFlag{
+				Name:  "with",
+				Usage: "start a sidecar container such as postgres:14 or db=postgres:14, reachable by its name",
+			},
+			&cli.BoolFlag{
+				Name:  "create-remote-user",
+				Usage: "create remoteUser in the image if it does not exist",
+			},
+			&cli.BoolFlag{
+				Name:  "update-remote-uid",
+				Usage: "run the container as the uid and gid of the current user instead of remoteUser",
+			},
+			&cli.StringFlag{
+				Name:    "locale",
+				Usage:   "display language of Code Server such as ja or zh-cn. It is ignored unless a language pack is available",
+				EnvVars: []string{"CODE_CODE_SERVER_LOCALE"},
+			},
+			&cli.DurationFlag{
+				Name:  "ready-timeout",
+				Usage: "how long to wait for Code Server to become ready",
+				Value: 5 * time.Minute,
+			},
+			&cli.DurationFlag{
+				Name:  "stop-timeout",
+				Usage: "grace period for Code Server to shut down before the container is killed",
+				Value: 10 * time.Second,
+			},
+			&cli.StringFlag{
+				Name:  "gpus",
+				Usage: "GPU devices to add to the container such as all. hostRequirements.gpu adds all GPUs when this is not given",
+			},
+			&cli.StringFlag{
+				Name:  "entrypoint-shell",
+				Usage: "shell running the entrypoint such as sh or /bin/bash. It defaults to bash if the image has it and sh otherwise",
+			},
+			&cli.StringFlag{
+				Name:  "code-server-install",
+				Usage: "URL of install.sh, path of a .deb or .rpm package of code-server, or none when the base image has code-server",
+			},
+			&cli.StringFlag{
+				Name:  "user-data-dir",
+				Usage: "user data dir of Code Server in the container",
+				Value: "/opt/code-server/.vscode",
+			},
+			&cli.StringFlag{
+				Name:  "extensions-dir",
+				Usage: "extensions dir of Code Server in the container. It defaults to extensions in the user data dir",
+			},
+			&cli.DurationFlag{
+				Name:  "gist-timeout",
+				Usage: "give up fetching the settings from the gist after this and use the local settings. 0 means no timeout",
+				Value: gist.DefaultTimeout,
+			},
+			&cli.BoolFlag{
+				Name:  "prefer-local-settings",
+				Usage: "keep settings in devcontainer.json over conflicting ones from Settings Sync",
+			},
+			&cli.StringSliceFlag{
+				Name:  "extension",
+				Usage: "install the extension in addition to the ones in devcontainer.json",
+			},
+			&cli.BoolFlag{
+				Name:  "no-extensions",
+				Usage: "do not install extensions to build faster",
+			},
+			&cli.BoolFlag{
+				Name:  "no-settings",
+				Usage: "do not use settings.json from Settings Sync. Settings in devcontainer.json are still used",
+			},
+			&cli.BoolFlag{
+				Name:  "no-project-settings",
+				Usage: "do not use .vscode/settings.json of the project as user settings",
+			},
+			&cli.BoolFlag{
+				Name:  "no-keybindings",
+				Usage: "do not use keybindings.json from Settings Sync",
+			},
+			&cli.BoolFlag{
+				Name:  "fail-on-extension-error",
+				Usage: "fail the build when an extension cannot be installed. Set false to install extensions on a best effort basis",
+				Value: true,
+			},
+			&cli.BoolFlag{
+				Name:  "strict-lifecycle",
+				Usage: "do not start Code Server when postCreateCommand fails",
+			},
+			&cli.BoolFlag{
+				Name:  "emit-events",
+				Usage: "print a JSON line to stdout when Code Server is ready",
+			},
+			&cli.BoolFlag{
+				Name:  "open",
+				Usage: "open Code Server in the default browser when it is ready",
+			},
+		},
+		Commands: []*cli.Command{
+			{
+				Name:      "logs",
+				Usage:     "follow the logs of a running container",
+				ArgsUsage: "<container-name>",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() == 0 {
+						return fmt.Errorf("Please provide a container name")
+					}
+					if err := checkDocker(); err != nil {
+						return err
+					}
+					return project.FollowLogs(c.Args().Get(0))
+				},
+			},
+			{
+				Name:      "init",
+				Usage:     "create .devcontainer/devcontainer.json and Dockerfile",
+				ArgsUsage: "[project-dir]",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:  "name",
+						Usage: "name of the dev container. The directory name is used by default",
+					},
+					&cli.StringFlag{
+						Name:  "image",
+						Usage: "base image of the Dockerfile",
+						Value: project.DefaultBaseImage,
+					},
+					&cli.StringSliceFlag{
+						Name:  "extension",
+						Usage: "extension to install",
+					},
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "overwrite existing files",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					projectDirPath := "."
+					if c.Args().Len() != 0 {
+						projectDirPath = c.Args().Get(0)
+					}
+					return project.InitProject(projectDirPath, project.InitOptions{
+						Name:       c.String("name"),
+						Image:      c.String("image"),
+						Extensions: c.StringSlice("extension"),
+						Force:      c.Bool("force"),
+					})
+				},
+			},
+			{
+				Name:      "exec",
+				Usage:     "run a command in a running container",
+				ArgsUsage: "<container-name or project-name> [--] <command...>",
+				Flags: []cli.Flag{
+					&cli.StringFlag{
+						Name:    "workdir",
+						Aliases: []string{"w"},
+						Usage:   "working directory of the command. It defaults to the workspace folder",
+					},
+					&cli.StringFlag{
+						Name:    "user",
+						Aliases: []string{"u"},
+						Usage:   "user of the command. It defaults to the user the container runs as",
+					},
+				},
+				Action: func(c *cli.Context) error {
+					name, command := splitArgs(c.Args().Slice(), false)
+					if name == "" {
+						return fmt.Errorf("Please provide a container name")
+					}
+					if len(command) == 0 {
+						return fmt.Errorf("Please provide a command")
+					}
+					if err := checkDocker(); err != nil {
+						return err
+					}
+					return project.ExecContainer(name, command, c.String("workdir"), c.String("user"))
+				},
+			},
+			{
+				Name:      "extensions",
+				Usage:     "list the extensions installed in a running container. Give the same --extensions-dir as the run",
+				ArgsUsage: "<container-name or project-name>",
+				Action: func(c *cli.Context) error {
+					name := c.Args().First()
+					if name == "" {
+						return fmt.Errorf("Please provide a container name")
+					}
+					if err := checkDocker(); err != nil {
+						return err
+					}
+					options := dockerfile.WrapOptions{UserDataDir: c.String("user-data-dir"), ExtensionsDir: c.String("extensions-dir")}
+					return project.ListExtensions(name, options)
+				},
+			},
+			{
+				Name:   "version",
+				Usage:  "print the versions of code-code-server, the container engine and code-server",
+				Action: printVersion,
+			},
+			{
+				Name:  "ls",
+				Usage: "list running containers",
+				Action: func(c *cli.Context) error {
+					if err := checkDocker(); err != nil {
+						return err
+					}
+					return project.ListContainers()
+				},
+			},
+			{
+				Name:      "stop",
+				Usage:     "stop a running container",
+				ArgsUsage: "<container-name or project-name>",
+				Flags: []cli.Flag{
+					&cli.DurationFlag{
+						Name:  "timeout",
+						Usage: "grace period before the container is killed",
+						Value: 10 * time.Second,
+					},
+				},
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() == 0 {
+						return fmt.Errorf("Please provide a container name")
+					}
+					if err := checkDocker(); err != nil {
+						return err
+					}
+					return project.StopContainer(c.Args().Get(0), c.Duration("timeout"))
+				},
+			},
+		},
 		Action: func(c *cli.Context) error {
-			if c.Args().Len() == 0 {
-				return fmt.Errorf("Please provide a project directory")
-			}
-
-			projectDirPath := c.Args().Get(0)
-			if _, err := os.Stat(projectDirPath); os.IsNotExist(err) {
-				return fmt.Errorf("Project directory does not exist")
+			devcontainerJsonPath, workspaceDirPath, err := findDevContainerJson(c.Args().Slice(), c.String("config-file"))
+			if err != nil {
+				return err
 			}
-
-			devcontainerDirPath := filepath.Join(projectDirPath, ".devcontainer")
-			if _, err := os.Stat(devcontainerDirPath); os.IsNotExist(err) {
-				return fmt.Errorf("Project directory does not contain a .devcontainer directory")
+			if err := checkDocker(); err != nil {
+				return err
 			}
 
-			devcontainerJsonPath := filepath.Join(devcontainerDirPath, "devcontainer.json")
-			devcontainerObj, err := devcontainer.ParseJson(devcontainerJsonPath)
+			devcontainerObj, err := project.ParseDevContainerInWorkspace(devcontainerJsonPath, workspaceDirPath)
 			if err != nil {
 				return err
 			}
+			if 0 < len(devcontainerObj.AppPort) {
+				log.Print("appPort is deprecated. Use forwardPorts instead")
+			}
 
-			settingsRepository, err := gist.New()
+			if err := setProxy(c.String("proxy")); err != nil {
+				return err
+			}
+			settingsRepository, err := gist.NewWithDefault(devcontainerObj.SettingsSyncGistId, c.Duration("gist-timeout"))
 			if err != nil {
 				return err
 			}
 
-			tag, err := project.BuildImage(devcontainerObj, &settingsRepository)
+			log.Printf("Using %s", project.DockerDaemon())
+			options := newOptions(c)
+			if err := options.Validate(); err != nil {
+				return err
+			}
+			if buildLog := c.String("build-log"); buildLog != "" {
+				f, err := os.Create(buildLog)
+				if err != nil {
+					return err
+				}
+				defer f.Close()
+				options.BuildOutput = f
+			}
+			buildCtx, cancel := newBuildContext(c.Duration("build-timeout"))
+			tag, err := project.BuildImage(buildCtx, devcontainerObj, &settingsRepository, options)
+			cancel()
 			if err != nil {
 				return err
 			}
 
-			url, err := project.GetServiceURL(devcontainerObj)
+			url, err := project.GetServiceURL(devcontainerObj, options)
 			if err != nil {
 				return err
 			}
 
-			ctx, err := project.NewContainerContext(tag, devcontainerObj, url)
+			ctx, err := project.NewContainerContext(tag, devcontainerObj, url, options)
 			if err != nil {
 				return err
 			}
 
-			prettyUrlPrint(url)
-			ctx.Run()
-
-			return nil
+			go onReady(c, url, project.GetForwardedPorts(devcontainerObj), ctx.Name())
+			return ctx.Run()
 		},
 	}
 
 	err := app.Run(os.Args)
 	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && 0 < exitErr.ExitCode() {
+			log.Print(err)
+			os.Exit(exitErr.ExitCode())
+		}
 		log.Fatal(err)
 	}
 }
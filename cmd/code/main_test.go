@@ -0,0 +1,61 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	project "github.com/ar90n/code-code-server"
+)
+
+func TestConfigFileWithProjectDirectory(t *testing.T) {
+	projectDirPath := t.TempDir()
+	configDirPath := filepath.Join(projectDirPath, "variants")
+	if err := os.Mkdir(configDirPath, 0755); err != nil {
+		t.Fatalf("Error creating variants: %s", err)
+	}
+	configFilePath := filepath.Join(configDirPath, "gpu.json")
+	if err := ioutil.WriteFile(configFilePath, []byte(`{"build": {"dockerfile": "Dockerfile"}}`), 0644); err != nil {
+		t.Fatalf("Error writing config file: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(configDirPath, "Dockerfile"), []byte("FROM golang:1.17\n"), 0644); err != nil {
+		t.Fatalf("Error writing Dockerfile: %s", err)
+	}
+
+	cases := []struct {
+		args          []string
+		workspacePath string
+		name          string
+	}{
+		{[]string{projectDirPath, "--", "--privileged"}, projectDirPath, filepath.Base(projectDirPath)},
+		{[]string{"--privileged"}, configDirPath, "variants"},
+	}
+	for _, c := range cases {
+		devcontainerJsonPath, workspaceDirPath, err := findDevContainerJson(c.args, configFilePath)
+		if err != nil {
+			t.Fatalf("Error finding devcontainer.json with %v: %s", c.args, err)
+		}
+		if devcontainerJsonPath != configFilePath {
+			t.Errorf("Expected devcontainer.json to be %s, got %s", configFilePath, devcontainerJsonPath)
+		}
+		devcontainer, err := project.ParseDevContainerInWorkspace(devcontainerJsonPath, workspaceDirPath)
+		if err != nil {
+			t.Fatalf("Error parsing devcontainer.json: %s", err)
+		}
+		if workspacePath := devcontainer.WorkspacePath(); workspacePath != c.workspacePath {
+			t.Errorf("Expected workspace with %v to be %s, got %s", c.args, c.workspacePath, workspacePath)
+		}
+		if devcontainer.Name != c.name {
+			t.Errorf("Expected name with %v to be %s, got %s", c.args, c.name, devcontainer.Name)
+		}
+		// the Dockerfile stays relative to the config file
+		if dockerfilePath := devcontainer.DockerfilePath(); dockerfilePath != filepath.Join(configDirPath, "Dockerfile") {
+			t.Errorf("Expected Dockerfile to be in %s, got %s", configDirPath, dockerfilePath)
+		}
+	}
+
+	if _, _, err := findDevContainerJson([]string{filepath.Join(projectDirPath, "missing")}, configFilePath); err == nil {
+		t.Errorf("Expected an error for a missing project directory")
+	}
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"time"
+
+	project "github.com/ar90n/code-code-server"
+	"github.com/google/go-github/v43/github"
+	"github.com/urfave/cli/v2"
+)
+
+// getEngineVersion returns the output of docker --version or podman --version.
+func getEngineVersion() string {
+	out, err := exec.Command(project.EngineBinary(), "--version").Output()
+	if err != nil {
+		return fmt.Sprintf("%s is not available: %s", project.EngineBinary(), err)
+	}
+	return strings.TrimSpace(string(out))
+}
+
+// getCodeServerVersion returns the version of code-server which is installed by the build.
+// install.sh installs the latest release, which is asked to GitHub.
+func getCodeServerVersion(codeServerInstall string) string {
+	switch {
+	case codeServerInstall == "none":
+		return "code-server of the base image"
+	case strings.HasSuffix(codeServerInstall, ".deb") || strings.HasSuffix(codeServerInstall, ".rpm"):
+		return fmt.Sprintf("code-server from %s", filepath.Base(codeServerInstall))
+	case codeServerInstall != "":
+		return fmt.Sprintf("code-server from %s", codeServerInstall)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	client := github.NewClient(nil)
+	release, _, err := client.Repositories.GetLatestRelease(ctx, "coder", "code-server")
+	if err != nil {
+		return fmt.Sprintf("code-server latest (failed to resolve the version: %s)", err)
+	}
+	return fmt.Sprintf("code-server %s (latest)", strings.TrimPrefix(release.GetTagName(), "v"))
+}
+
+func printVersion(c *cli.Context) error {
+	fmt.Printf("code-code-server %s\n", project.Version)
+	fmt.Println(getEngineVersion())
+	fmt.Println(getCodeServerVersion(c.String("code-server-install")))
+	return nil
+}
@@ -0,0 +1,20 @@
+package main
+
+import "testing"
+
+func TestCodeServerVersion(t *testing.T) {
+	cases := []struct {
+		codeServerInstall string
+		expected          string
+	}{
+		{"none", "code-server of the base image"},
+		{"/home/user/code-server_4.1.0_amd64.deb", "code-server from code-server_4.1.0_amd64.deb"},
+		{"/home/user/code-server-4.1.0-amd64.rpm", "code-server from code-server-4.1.0-amd64.rpm"},
+		{"https://mirror.example.com/install.sh", "code-server from https://mirror.example.com/install.sh"},
+	}
+	for _, c := range cases {
+		if version := getCodeServerVersion(c.codeServerInstall); version != c.expected {
+			t.Errorf("Expected version of %s to be %s, got %s", c.codeServerInstall, c.expected, version)
+		}
+	}
+}
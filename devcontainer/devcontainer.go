@@ -1,9 +1,11 @@
 package devcontainer
 
 import (
+	"fmt"
 	"github.com/flynn/json5"
 	"io/ioutil"
 	"path/filepath"
+	"strconv"
 )
 
 type PortAttribute struct {
@@ -11,6 +13,88 @@ type PortAttribute struct {
 	OnAutoForward string `json:"onAutoForward"`
 }
 
+// AppPort holds appPort which is either a port, a "host:container" string or an array of them.
+type AppPort []string
+
+func (a *AppPort) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json5.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	values, ok := value.([]interface{})
+	if !ok {
+		values = []interface{}{value}
+	}
+	ports := AppPort{}
+	for _, v := range values {
+		switch v := v.(type) {
+		case float64:
+			ports = append(ports, strconv.FormatFloat(v, 'f', -1, 64))
+		case string:
+			ports = append(ports, v)
+		default:
+			return fmt.Errorf("appPort must be a number, a string or an array of them, got %v", v)
+		}
+	}
+	*a = ports
+	return nil
+}
+
+// GpuRequirement holds hostRequirements.gpu which is a boolean, "optional" or an object with cores and memory.
+type GpuRequirement struct {
+	Required bool
+	Optional bool
+	Cores    int
+	Memory   string
+}
+
+func (g *GpuRequirement) UnmarshalJSON(data []byte) error {
+	var value interface{}
+	if err := json5.Unmarshal(data, &value); err != nil {
+		return err
+	}
+
+	switch v := value.(type) {
+	case bool:
+		*g = GpuRequirement{Required: v}
+	case string:
+		if v != "optional" {
+			return fmt.Errorf("hostRequirements.gpu must be true, false, \"optional\" or an object, got %s", v)
+		}
+		*g = GpuRequirement{Optional: true}
+	case map[string]interface{}:
+		*g = GpuRequirement{Required: true}
+		if cores, ok := v["cores"].(float64); ok {
+			g.Cores = int(cores)
+		}
+		if memory, ok := v["memory"].(string); ok {
+			g.Memory = memory
+		}
+	default:
+		return fmt.Errorf("hostRequirements.gpu must be true, false, \"optional\" or an object, got %v", v)
+	}
+	return nil
+}
+
+type HostRequirements struct {
+	Cpus    int            `json:"cpus"`
+	Memory  string         `json:"memory"`
+	Storage string         `json:"storage"`
+	Gpu     GpuRequirement `json:"gpu"`
+}
+
+// VscodeCustomizations holds customizations.vscode which replaces the top level extensions and settings.
+type VscodeCustomizations struct {
+	Extensions         []string               `json:"extensions"`
+	Settings           map[string]interface{} `json:"settings"`
+	SettingsSyncGistId string                 `json:"settingsSyncGistId"`
+}
+
+type Customizations struct {
+	Vscode VscodeCustomizations `json:"vscode"`
+}
+
 type DevContainer struct {
 	DirPath string
 	Name    string `json:"name"`
@@ -18,19 +102,120 @@ type DevContainer struct {
 		Dockerfile string            `json:"dockerfile"`
 		Context    string            `json:"context"`
 		Args       map[string]string `json:"args"`
+		Target     string            `json:"target"`
+		Platform   string            `json:"platform"`
 	} `json:"build"`
 	RunArgs           []string                 `json:"runArgs"`
 	WorkspaceMount    string                   `json:"workspaceMount"`
+	Mounts            []string                 `json:"mounts"`
 	WorkspaceFolder   string                   `json:"workspaceFolder"`
 	Settings          map[string]interface{}   `json:"settings"`
 	Extensions        []string                 `json:"extensions"`
 	ForwardPorts      []string                 `json:"forwardPorts"`
+	AppPort           AppPort                  `json:"appPort"`
 	PortsAttributes   map[string]PortAttribute `json:"portsAttributes"`
 	PostCreateCommand string                   `json:"postCreateCommand"`
+	WaitFor           string                   `json:"waitFor"`
+	ShutdownAction    string                   `json:"shutdownAction"`
+	UserEnvProbe      string                   `json:"userEnvProbe"`
 	RemoteUser        string                   `json:"remoteUser"`
+	ContainerEnv      map[string]string        `json:"containerEnv"`
+	RemoteEnv         map[string]string        `json:"remoteEnv"`
+	OverrideCommand   *bool                    `json:"overrideCommand"`
+	HostRequirements  HostRequirements         `json:"hostRequirements"`
+	Customizations    Customizations           `json:"customizations"`
+	// SettingsSyncGistId is the gist of the settings shared by the project. SETTINGS_SYNC_GIST_ID takes precedence
+	SettingsSyncGistId string `json:"settingsSyncGistId"`
+	// WorkspaceDir is the project directory when it is given apart from devcontainer.json
+	WorkspaceDir string `json:"-"`
+}
+
+// DockerfilePath returns the path of build.dockerfile which is relative to devcontainer.json.
+func (d *DevContainer) DockerfilePath() string {
+	return filepath.Join(d.DirPath, d.Build.Dockerfile)
+}
+
+// WorkspacePath returns the project directory. devcontainer.json is either in .devcontainer of it
+// or is .devcontainer.json at its root, unless WorkspaceDir is given.
+func (d *DevContainer) WorkspacePath() string {
+	if d.WorkspaceDir != "" {
+		return d.WorkspaceDir
+	}
+	if filepath.Base(d.DirPath) == ".devcontainer" {
+		return filepath.Dir(d.DirPath)
+	}
+	return d.DirPath
+}
+
+// GetWaitFor returns the lifecycle command which must finish before the container is ready.
+// It defaults to postCreateCommand.
+func (d *DevContainer) GetWaitFor() string {
+	if d.WaitFor == "" {
+		return "postCreateCommand"
+	}
+	return d.WaitFor
+}
+
+// WaitsForPostCreateCommand reports whether postCreateCommand must finish before the container is ready.
+func (d *DevContainer) WaitsForPostCreateCommand() bool {
+	switch d.GetWaitFor() {
+	case "initializeCommand", "onCreateCommand", "updateContentCommand":
+		return false
+	}
+	return true
+}
+
+// GetShutdownAction returns what happens to the container when code-code-server exits.
+// It defaults to stopContainer.
+func (d *DevContainer) GetShutdownAction() string {
+	if d.ShutdownAction == "" {
+		return "stopContainer"
+	}
+	return d.ShutdownAction
+}
+
+// GetUserEnvProbe returns the kind of shell whose environment code-server inherits.
+// It defaults to loginInteractiveShell as VS Code does.
+func (d *DevContainer) GetUserEnvProbe() string {
+	if d.UserEnvProbe == "" {
+		return "loginInteractiveShell"
+	}
+	return d.UserEnvProbe
+}
+
+// ShouldOverrideCommand reports whether Code Server replaces the command of the image.
+// It defaults to true as overrideCommand does in the devcontainer spec.
+func (d *DevContainer) ShouldOverrideCommand() bool {
+	return d.OverrideCommand == nil || *d.OverrideCommand
+}
+
+// mergeCustomizations merges customizations.vscode into the deprecated top level extensions and settings.
+// customizations.vscode.settings takes precedence over the conflicting top level ones.
+func (d *DevContainer) mergeCustomizations() {
+	d.Extensions = append(d.Extensions, d.Customizations.Vscode.Extensions...)
+	if d.Customizations.Vscode.SettingsSyncGistId != "" {
+		d.SettingsSyncGistId = d.Customizations.Vscode.SettingsSyncGistId
+	}
+	if len(d.Customizations.Vscode.Settings) == 0 {
+		return
+	}
+	settings := map[string]interface{}{}
+	for k, v := range d.Settings {
+		settings[k] = v
+	}
+	for k, v := range d.Customizations.Vscode.Settings {
+		settings[k] = v
+	}
+	d.Settings = settings
 }
 
 func ParseJson(path string) (DevContainer, error) {
+	return ParseJsonInWorkspace(path, "")
+}
+
+// ParseJsonInWorkspace parses devcontainer.json at path which belongs to the project in workspaceDir.
+// The project directory is derived from path when workspaceDir is empty.
+func ParseJsonInWorkspace(path string, workspaceDir string) (DevContainer, error) {
 	var devcontainer DevContainer
 	raw, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -44,5 +229,15 @@ func ParseJson(path string) (DevContainer, error) {
 		return devcontainer, err
 	}
 	devcontainer.DirPath = absDirPath
+	if workspaceDir != "" {
+		if devcontainer.WorkspaceDir, err = filepath.Abs(workspaceDir); err != nil {
+			return devcontainer, err
+		}
+	}
+	devcontainer.mergeCustomizations()
+	// name is optional in the spec
+	if devcontainer.Name == "" {
+		devcontainer.Name = filepath.Base(devcontainer.WorkspacePath())
+	}
 	return devcontainer, nil
 }
@@ -1,8 +1,11 @@
 package devcontainer
 
 import (
+	"github.com/flynn/json5"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
 	"testing"
 )
 
@@ -98,3 +101,109 @@ func TestDevcontainer(t *testing.T) {
 		t.Errorf("Expected devcontainer.json remoteUser to be 'vscode', got %s", devcontainer.RemoteUser)
 	}
 }
+
+func TestAppPort(t *testing.T) {
+	cases := []struct {
+		contents string
+		expected []string
+	}{
+		{`{"appPort": 3000}`, []string{"3000"}},
+		{`{"appPort": "8000:8080"}`, []string{"8000:8080"}},
+		{`{"appPort": [3000, "8000:8080"]}`, []string{"3000", "8000:8080"}},
+		{`{}`, nil},
+	}
+
+	for _, c := range cases {
+		var devcontainer DevContainer
+		if err := json5.Unmarshal([]byte(c.contents), &devcontainer); err != nil {
+			t.Errorf("Error parsing %s: %s", c.contents, err)
+		}
+		if !reflect.DeepEqual([]string(devcontainer.AppPort), c.expected) {
+			t.Errorf("Expected appPort of %s to be %v, got %v", c.contents, c.expected, devcontainer.AppPort)
+		}
+	}
+
+	var devcontainer DevContainer
+	if err := json5.Unmarshal([]byte(`{"appPort": true}`), &devcontainer); err == nil {
+		t.Errorf("Expected an error when appPort is a boolean")
+	}
+}
+
+func TestHostRequirements(t *testing.T) {
+	cases := []struct {
+		contents string
+		expected GpuRequirement
+	}{
+		{`{"hostRequirements": {"gpu": true}}`, GpuRequirement{Required: true}},
+		{`{"hostRequirements": {"gpu": false}}`, GpuRequirement{}},
+		{`{"hostRequirements": {"gpu": "optional"}}`, GpuRequirement{Optional: true}},
+		{`{"hostRequirements": {"gpu": {"cores": 1000, "memory": "8gb"}}}`, GpuRequirement{Required: true, Cores: 1000, Memory: "8gb"}},
+		{`{"hostRequirements": {"cpus": 4}}`, GpuRequirement{}},
+	}
+
+	for _, c := range cases {
+		var devcontainer DevContainer
+		if err := json5.Unmarshal([]byte(c.contents), &devcontainer); err != nil {
+			t.Errorf("Error parsing %s: %s", c.contents, err)
+		}
+		if devcontainer.HostRequirements.Gpu != c.expected {
+			t.Errorf("Expected hostRequirements.gpu of %s to be %+v, got %+v", c.contents, c.expected, devcontainer.HostRequirements.Gpu)
+		}
+	}
+
+	var devcontainer DevContainer
+	if err := json5.Unmarshal([]byte(`{"hostRequirements": {"gpu": "always"}}`), &devcontainer); err == nil {
+		t.Errorf("Expected an error when hostRequirements.gpu is an unknown string")
+	}
+}
+
+func TestDefaultName(t *testing.T) {
+	projectDirPath, _ := ioutil.TempDir("", "project")
+	defer os.RemoveAll(projectDirPath)
+	os.Mkdir(filepath.Join(projectDirPath, ".devcontainer"), 0755)
+
+	for _, path := range []string{filepath.Join(projectDirPath, ".devcontainer", "devcontainer.json"), filepath.Join(projectDirPath, ".devcontainer.json")} {
+		ioutil.WriteFile(path, []byte(`{"build": {"dockerfile": "Dockerfile"}}`), 0644)
+		devcontainer, err := ParseJson(path)
+		if err != nil {
+			t.Errorf("Error parsing %s: %v", path, err)
+		}
+		if devcontainer.Name != filepath.Base(projectDirPath) {
+			t.Errorf("Expected name of %s to be %s, got %s", path, filepath.Base(projectDirPath), devcontainer.Name)
+		}
+	}
+}
+
+func TestCustomizations(t *testing.T) {
+	tmpFile, _ := ioutil.TempFile("", "devcontainer.json")
+	defer os.Remove(tmpFile.Name())
+	tmpFile.WriteString(`{
+		"extensions": ["golang.Go", "eamodio.gitlens"],
+		"settings": {"go.gopath": "/go", "editor.tabSize": 8},
+		"settingsSyncGistId": "0123",
+		"customizations": {
+			"vscode": {
+				"extensions": ["golang.Go", "ms-python.python"],
+				"settings": {"editor.tabSize": 4},
+				"settingsSyncGistId": "4567"
+			}
+		}
+	}`)
+	tmpFile.Close()
+
+	devcontainer, err := ParseJson(tmpFile.Name())
+	if err != nil {
+		t.Fatalf("Error parsing devcontainer.json: %s", err)
+	}
+	expectedExtensions := []string{"golang.Go", "eamodio.gitlens", "golang.Go", "ms-python.python"}
+	if !reflect.DeepEqual(devcontainer.Extensions, expectedExtensions) {
+		t.Errorf("Expected extensions to be %v, got %v", expectedExtensions, devcontainer.Extensions)
+	}
+	expectedSettings := map[string]interface{}{"go.gopath": "/go", "editor.tabSize": float64(4)}
+	if !reflect.DeepEqual(devcontainer.Settings, expectedSettings) {
+		t.Errorf("Expected settings to be %v, got %v", expectedSettings, devcontainer.Settings)
+	}
+	if devcontainer.SettingsSyncGistId != "4567" {
+		t.Errorf("Expected settingsSyncGistId to be 4567, got %s", devcontainer.SettingsSyncGistId)
+	}
+}
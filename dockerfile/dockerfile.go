@@ -3,7 +3,6 @@ package dockerfile
 import (
 	"bytes"
 	"context"
-	b64 "encoding/base64"
 	"encoding/json"
 	"fmt"
 	. "github.com/ar90n/code-code-server/devcontainer"
@@ -12,8 +11,13 @@ import (
 	"github.com/imdario/mergo"
 	"io/ioutil"
 	"log"
+	"net/url"
+	"os"
 	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
 )
 
 type KeyBinding struct {
@@ -22,29 +26,356 @@ type KeyBinding struct {
 	When    string `json:"when"`
 }
 
+type WrapOptions struct {
+	Locale                string
+	IgnoreExtensionErrors bool
+	CreateRemoteUser      bool
+	UserDataDir           string
+	ExtensionsDir         string
+	// PreferLocalSettings keeps settings in devcontainer.json over conflicting synced ones
+	PreferLocalSettings bool
+	// CodeServerInstall is the URL of install.sh, the path of a .deb or .rpm package of code-server, or none
+	// when the base image has code-server. It defaults to https://code-server.dev/install.sh
+	CodeServerInstall string
+	// Extensions are installed in addition to the extensions in devcontainer.json
+	Extensions []string
+	// NoExtensions, NoSettings and NoKeybindings skip installing extensions, the settings from Settings Sync
+	// and the keybindings from Settings Sync to build faster
+	NoExtensions  bool
+	NoSettings    bool
+	NoKeybindings bool
+	// NoProjectSettings ignores .vscode/settings.json of the project
+	NoProjectSettings bool
+	// StrictLifecycle aborts the entrypoint when a lifecycle command fails instead of starting code-server
+	StrictLifecycle bool
+	// CodeServerDirOwner owns the code-server directories in place of remoteUser, such as uid:gid of the
+	// user the container runs as
+	CodeServerDirOwner string
+	// CloneRepository is cloned into CloneFolder when the container starts with it empty, for the workspace
+	// which is not mounted from the host
+	CloneRepository string
+	// CloneFolder is the workspace folder which is created in the image for the user running code-server
+	CloneFolder string
+	// EntrypointShell runs the entry script, such as /bin/sh or bash. It defaults to bash if the image has it
+	// and sh otherwise
+	EntrypointShell string
+	// PersistedDirs are the directories of the user data dir which volumes are mounted on. They are created
+	// in the image so that the volumes are initialized writable by the user running code-server
+	PersistedDirs []string
+}
+
+const (
+	codeServerDir      = "/opt/code-server/"
+	defaultUserDataDir = "/opt/code-server/.vscode"
+)
+
+// GetUserDataDir returns the user data dir of code-server in the image.
+func (o *WrapOptions) GetUserDataDir() string {
+	if o.UserDataDir == "" {
+		return defaultUserDataDir
+	}
+	return strings.TrimSuffix(o.UserDataDir, "/")
+}
+
+// GetExtensionsDir returns the extensions dir of code-server in the image. It defaults to
+// the extensions directory in the user data dir.
+func (o *WrapOptions) GetExtensionsDir() string {
+	if o.ExtensionsDir == "" {
+		return o.GetUserDataDir() + "/extensions/"
+	}
+	return o.ExtensionsDir
+}
+
+var languagePacks = map[string]string{
+	"cs":    "MS-CEINTL.vscode-language-pack-cs",
+	"de":    "MS-CEINTL.vscode-language-pack-de",
+	"es":    "MS-CEINTL.vscode-language-pack-es",
+	"fr":    "MS-CEINTL.vscode-language-pack-fr",
+	"it":    "MS-CEINTL.vscode-language-pack-it",
+	"ja":    "MS-CEINTL.vscode-language-pack-ja",
+	"ko":    "MS-CEINTL.vscode-language-pack-ko",
+	"pl":    "MS-CEINTL.vscode-language-pack-pl",
+	"pt-br": "MS-CEINTL.vscode-language-pack-pt-BR",
+	"ru":    "MS-CEINTL.vscode-language-pack-ru",
+	"tr":    "MS-CEINTL.vscode-language-pack-tr",
+	"zh-cn": "MS-CEINTL.vscode-language-pack-zh-hans",
+	"zh-tw": "MS-CEINTL.vscode-language-pack-zh-hant",
+}
+
+// resolveLocale normalizes a locale such as ja_JP.UTF-8 into the form code-server expects
+// and returns the language pack extension needed for it. A locale without a language pack is
+// not used, as code-server would show English anyway.
+func resolveLocale(locale string) (string, string) {
+	locale = strings.SplitN(locale, ".", 2)[0]
+	locale = strings.ToLower(strings.ReplaceAll(locale, "_", "-"))
+
+	if languagePack, ok := languagePacks[locale]; ok {
+		return locale, languagePack
+	}
+	language := strings.SplitN(locale, "-", 2)[0]
+	if languagePack, ok := languagePacks[language]; ok {
+		return language, languagePack
+	}
+	return "", ""
+}
+
 const (
 	CodeServerInstall = `RUN curl -fsSL https://code-server.dev/install.sh | sh`
 	Entrypoint        = `ENTRYPOINT ["/opt/code-server/entrypoint.sh"]`
+	// EntryScript is the script which starts code-server in the container
+	EntryScript = "/opt/code-server/entrypoint.sh"
+	// postCreateMarker is created in the container when postCreateCommand succeeded
+	postCreateMarker = "/opt/code-server/.postCreateCommand.done"
+	// StageName is the stage holding the code-server layers when build.target is given
+	StageName = "code-code-server"
+	// GeneratedDir is the directory in the build context holding GeneratedFiles and the Dockerfile
+	GeneratedDir = ".code-code-server"
+	// BindAddrEnv overrides the address code-server listens on in the container, such as on the host network
+	BindAddrEnv = "CODE_CODE_SERVER_BIND_ADDR"
 )
 
-func createEntryScriptCommands(ctx context.Context, devcontainer DevContainer) ([]string, error) {
-	scriptCommands := []string{`#!/bin/bash`, `set -e`, `set -x`, devcontainer.PostCreateCommand}
-	scriptCommands = append(scriptCommands, `code-server --user-data-dir /opt/code-server/.vscode --config /opt/code-server/config.yml --bind-addr 0.0.0.0:8080`)
+// GeneratedFile is a file added to the build context. It has either its contents or HostPath, the path
+// of a file on the host which is copied as is, so that large files are not held in memory.
+type GeneratedFile struct {
+	Contents string
+	HostPath string
+}
+
+// GeneratedFiles holds the files which are added to GeneratedDir of the build context, keyed by their name.
+type GeneratedFiles map[string]GeneratedFile
+
+// copyFileCommand adds contents to files and returns the instruction which copies it to path in the image.
+func copyFileCommand(path string, contents string, files GeneratedFiles) string {
+	name := filepath.Base(path)
+	files[name] = GeneratedFile{Contents: contents}
+	return fmt.Sprintf("COPY %s/%s %s", GeneratedDir, name, path)
+}
+
+// copyHostFileCommand adds the file at hostPath to files and returns the instruction which copies it to
+// path in the image.
+func copyHostFileCommand(path string, hostPath string, files GeneratedFiles) string {
+	name := filepath.Base(path)
+	files[name] = GeneratedFile{HostPath: hostPath}
+	return fmt.Sprintf("COPY %s/%s %s", GeneratedDir, name, path)
+}
+
+// runOnce wraps postCreateCommand so that it runs when the container is started for the first time, with
+// the workspace mounted. A marker in the container records that it succeeded, so restarting the container
+// does not run it again.
+func runOnce(command string, options WrapOptions) string {
+	command = fmt.Sprintf("%s\ntouch %s", command, postCreateMarker)
+	if !options.StrictLifecycle {
+		command = tolerateFailure("postCreateCommand", command)
+	}
+	return fmt.Sprintf("if [ ! -e %s ]; then\n%s\nfi", postCreateMarker, command)
+}
+
+// tolerateFailure wraps the lifecycle command so that its failure is logged and the entrypoint goes on to
+// start code-server. The command itself still stops at the first failure.
+func tolerateFailure(name string, command string) string {
+	return strings.Join([]string{
+		"set +e",
+		"(",
+		"set -e",
+		command,
+		")",
+		"status=$?",
+		"set -e",
+		fmt.Sprintf(`[ $status -eq 0 ] || echo "%s failed with status $status. Starting code-server anyway" >&2`, name),
+	}, "\n")
+}
+
+// shellQuote quotes the string as a single word of sh.
+func shellQuote(str string) string {
+	return "'" + strings.ReplaceAll(str, "'", `'\''`) + "'"
+}
+
+// cloneCommand clones the repository into the folder unless it already has files such as the ones cloned
+// by the previous run.
+func cloneCommand(repository string, folder string) string {
+	return fmt.Sprintf(`if [ -z "$(ls -A %[2]s)" ]; then git clone %[1]s %[2]s; fi`, shellQuote(repository), shellQuote(folder))
+}
+
+var (
+	// EnvNamePattern matches the names of environment variables which containerEnv and remoteEnv may set
+	EnvNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+	// envReferencePattern matches ${localEnv:VAR} and ${containerEnv:VAR} with an optional default value
+	envReferencePattern = regexp.MustCompile(`\$\{(localEnv|containerEnv):([a-zA-Z_][a-zA-Z0-9_]*)(?::([^}]*))?\}`)
+	doubleQuoteEscaper  = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "$", `\$`, "`", "\\`")
+)
+
+// localEnvPrefix prefixes the host variables passed to the container for remoteEnv, so that they do not
+// shadow the variables of the container such as HOME.
+const localEnvPrefix = "CODE_CODE_SERVER_LOCAL_ENV_"
+
+// remoteEnvValue returns the value of remoteEnv as a double quoted word of sh. Both ${localEnv:VAR} and
+// ${containerEnv:VAR} are left to the shell, so that the host environment is not written in the image and
+// containerEnv is resolved after it and the environment of the image are set.
+func remoteEnvValue(value string) string {
+	var result strings.Builder
+	result.WriteString(`"`)
+	last := 0
+	for _, match := range envReferencePattern.FindAllStringSubmatchIndex(value, -1) {
+		result.WriteString(doubleQuoteEscaper.Replace(value[last:match[0]]))
+		last = match[1]
+
+		name := value[match[4]:match[5]]
+		if value[match[2]:match[3]] == "localEnv" {
+			name = localEnvPrefix + name
+		}
+		if match[6] != -1 && match[6] != match[7] {
+			result.WriteString(fmt.Sprintf("${%s:-%s}", name, doubleQuoteEscaper.Replace(value[match[6]:match[7]])))
+		} else {
+			result.WriteString(fmt.Sprintf("${%s}", name))
+		}
+	}
+	result.WriteString(doubleQuoteEscaper.Replace(value[last:]))
+	result.WriteString(`"`)
+	return result.String()
+}
+
+// remoteEnvCommands returns the commands exporting remoteEnv in the entry script, so that code-server and
+// the lifecycle commands see it.
+func remoteEnvCommands(remoteEnv map[string]string) ([]string, error) {
+	keys := []string{}
+	for k := range remoteEnv {
+		if !EnvNamePattern.MatchString(k) {
+			return nil, fmt.Errorf("remoteEnv %s is not a valid variable name", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	commands := []string{}
+	for _, k := range keys {
+		commands = append(commands, fmt.Sprintf("export %s=%s", k, remoteEnvValue(remoteEnv[k])))
+	}
+	return commands, nil
+}
+
+// RemoteEnvLocalEnv returns the host variables which remoteEnv refers to by ${localEnv:VAR} as NAME=value
+// pairs for docker run -e. They are passed on run instead of being written in the image.
+func RemoteEnvLocalEnv(remoteEnv map[string]string, getenv func(string) string) []string {
+	names := map[string]bool{}
+	for _, v := range remoteEnv {
+		for _, match := range envReferencePattern.FindAllStringSubmatch(v, -1) {
+			if match[1] == "localEnv" {
+				names[match[2]] = true
+			}
+		}
+	}
+	pairs := []string{}
+	for name := range names {
+		pairs = append(pairs, fmt.Sprintf("%s%s=%s", localEnvPrefix, name, getenv(name)))
+	}
+	sort.Strings(pairs)
+	return pairs
+}
+
+var userEnvProbeFlags = map[string]string{
+	"none":                  "",
+	"loginShell":            "-lc",
+	"interactiveShell":      "-ic",
+	"loginInteractiveShell": "-lic",
+}
+
+// userEnvProbeCommand returns the command which exports the environment of the shell started as userEnvProbe
+// says, so that tools set up in the profiles are found. Only export -p is captured as the profiles may print.
+func userEnvProbeCommand(userEnvProbe string, shell string) (string, error) {
+	flags, ok := userEnvProbeFlags[userEnvProbe]
+	if !ok {
+		return "", fmt.Errorf("userEnvProbe must be one of none, loginShell, interactiveShell and loginInteractiveShell, got %s", userEnvProbe)
+	}
+	if flags == "" {
+		return "", nil
+	}
+	return fmt.Sprintf(`eval "$(%s %s 'export -p >&3' 3>&1 >/dev/null 2>&1 </dev/null)" || true`, shell, flags), nil
+}
+
+var shellPathPattern = regexp.MustCompile(`^[a-zA-Z0-9_./-]+$`)
+
+// getEntrypointShell returns the first lines of the entry script and the shell which probes userEnvProbe.
+// Without EntrypointShell, the script starts with sh, which every image has, and switches to bash if the
+// image has it as postCreateCommand may use bashisms.
+func getEntrypointShell(options WrapOptions) ([]string, string, error) {
+	shell := options.EntrypointShell
+	if shell == "" {
+		reexec := `if [ -z "$BASH_VERSION" ] && command -v bash >/dev/null 2>&1; then exec bash "$0" "$@"; fi`
+		return []string{`#!/bin/sh`, reexec}, `"${BASH:-sh}"`, nil
+	}
+	if !shellPathPattern.MatchString(shell) {
+		return nil, "", fmt.Errorf("Entrypoint shell %s is not a path of a shell", shell)
+	}
+	if !strings.HasPrefix(shell, "/") {
+		shell = "/bin/" + shell
+	}
+	return []string{"#!" + shell}, shell, nil
+}
+
+func createEntryScriptCommands(ctx context.Context, devcontainer DevContainer, options WrapOptions) ([]string, error) {
+	postCreateCommand := devcontainer.PostCreateCommand
+	if postCreateCommand != "" {
+		postCreateCommand = runOnce(postCreateCommand, options)
+	}
+	if postCreateCommand != "" && !devcontainer.WaitsForPostCreateCommand() {
+		// code-server becomes ready without waiting for postCreateCommand
+		postCreateCommand = fmt.Sprintf("(\n%s\n) &", postCreateCommand)
+	}
+	header, shell, err := getEntrypointShell(options)
+	if err != nil {
+		return nil, err
+	}
+	probeCommand, err := userEnvProbeCommand(devcontainer.GetUserEnvProbe(), shell)
+	if err != nil {
+		return nil, err
+	}
+	remoteEnv, err := remoteEnvCommands(devcontainer.RemoteEnv)
+	if err != nil {
+		return nil, err
+	}
+	scriptCommands := append(header, `set -e`)
+	if probeCommand != "" {
+		// probe before set -x not to trace the whole environment
+		scriptCommands = append(scriptCommands, probeCommand)
+	}
+	// remoteEnv is applied on top of the probed environment
+	scriptCommands = append(scriptCommands, remoteEnv...)
+	scriptCommands = append(scriptCommands, `set -x`)
+	if options.CloneRepository != "" {
+		// postCreateCommand needs the source
+		scriptCommands = append(scriptCommands, cloneCommand(options.CloneRepository, options.CloneFolder))
+	}
+	scriptCommands = append(scriptCommands, postCreateCommand)
+	codeServerCommand := fmt.Sprintf(`code-server --user-data-dir %s --config /opt/code-server/config.yml --bind-addr "${%s:-0.0.0.0:8080}"`, options.GetUserDataDir(), BindAddrEnv)
+	if options.ExtensionsDir != "" {
+		codeServerCommand += " --extensions-dir " + options.GetExtensionsDir()
+	}
+	if locale, _ := resolveLocale(options.Locale); locale != "" {
+		codeServerCommand += " --locale " + locale
+	}
+	if devcontainer.ShouldOverrideCommand() {
+		scriptCommands = append(scriptCommands, codeServerCommand)
+		return scriptCommands, nil
+	}
+
+	// keep code-server in the background and hand over to the command of the image
+	scriptCommands = append(scriptCommands,
+		codeServerCommand+" &",
+		`if [ $# -eq 0 ]; then wait; else exec "$@"; fi`,
+	)
 	return scriptCommands, nil
 }
 
-func createEntryScript(ctx context.Context, devcontainer DevContainer) (string, error) {
-	entryScriptCommands, err := createEntryScriptCommands(ctx, devcontainer)
+func createEntryScript(ctx context.Context, devcontainer DevContainer, options WrapOptions, files GeneratedFiles) (string, error) {
+	entryScriptCommands, err := createEntryScriptCommands(ctx, devcontainer, options)
 	if err != nil {
 		return "", err
 	}
 	entryScriptContents := strings.Join(entryScriptCommands, "\n")
-	b64EntryScriptContents := b64.StdEncoding.EncodeToString([]byte(entryScriptContents))
 
 	dockerfileCommands := []string{
-		`RUN mkdir -p /opt/code-server`,
-		`RUN echo '` + b64EntryScriptContents + `' | base64 -d > /opt/code-server/entrypoint.sh`,
-		`RUN chmod +x /opt/code-server/entrypoint.sh`,
+		copyFileCommand(EntryScript, entryScriptContents, files),
+		`RUN chmod +x ` + EntryScript,
 	}
 	result := strings.Join(dockerfileCommands, "\n")
 	return result, nil
@@ -54,7 +385,9 @@ func dumpAsJson(obj interface{}) (string, error) {
 	data := new(bytes.Buffer)
 	encoder := json.NewEncoder(data)
 	encoder.SetEscapeHTML(false)
-	encoder.Encode(obj)
+	if err := encoder.Encode(obj); err != nil {
+		return "", err
+	}
 
 	var out bytes.Buffer
 	err := json.Indent(&out, data.Bytes(), "", "  ")
@@ -65,17 +398,51 @@ func dumpAsJson(obj interface{}) (string, error) {
 	return out.String(), nil
 }
 
-func createSettingJson(ctx context.Context, devcontainer DevContainer, repository Repository) (string, error) {
-	settings := devcontainer.Settings
-	if settings == nil {
-		settings = map[string]interface{}{}
+// mergeSyncedSettings merges the synced settings.json into settings and returns the result as JSON.
+func mergeSyncedSettings(settings map[string]interface{}, contentsFromSync string, options WrapOptions) (string, error) {
+	var obj map[string]interface{}
+	if err := json5.Unmarshal([]byte(contentsFromSync), &obj); err != nil {
+		return "", err
 	}
 
-	if contentsFromSync, err := repository.Get(ctx, "settings.json"); err == nil {
-		var obj map[string]interface{}
-		if err := json5.Unmarshal([]byte(contentsFromSync), &obj); err == nil {
-			mergo.Merge(&settings, obj)
+	// synced settings override conflicting local ones as VS Code Settings Sync does
+	mergeOptions := []func(*mergo.Config){mergo.WithOverride}
+	if options.PreferLocalSettings {
+		mergeOptions = nil
+	}
+	if err := mergo.Merge(&settings, obj, mergeOptions...); err != nil {
+		return "", err
+	}
+	return dumpAsJson(settings)
+}
+
+// readProjectSettings returns .vscode/settings.json of the project, which settings in devcontainer.json
+// and Settings Sync override. It is empty when the file does not exist or is broken.
+func readProjectSettings(devcontainer DevContainer, options WrapOptions) map[string]interface{} {
+	settings := map[string]interface{}{}
+	if options.NoProjectSettings {
+		return settings
+	}
+	path := filepath.Join(devcontainer.WorkspacePath(), ".vscode", "settings.json")
+	raw, err := ioutil.ReadFile(path)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("Ignoring %s: %s", path, err)
 		}
+		return settings
+	}
+	if err := json5.Unmarshal(raw, &settings); err != nil {
+		log.Printf("Ignoring %s: %s", path, err)
+		return map[string]interface{}{}
+	}
+	return settings
+}
+
+func createSettingJson(ctx context.Context, devcontainer DevContainer, repository Repository, options WrapOptions, files GeneratedFiles) (string, error) {
+	// copy the local settings so that merging does not modify the devcontainer
+	settings := readProjectSettings(devcontainer, options)
+	for k, v := range devcontainer.Settings {
+		settings[k] = v
 	}
 
 	settingsJsonContents, err := dumpAsJson(settings)
@@ -83,21 +450,72 @@ func createSettingJson(ctx context.Context, devcontainer DevContainer, repositor
 		return "", err
 	}
 
-	b64SettingsJsonContents := b64.StdEncoding.EncodeToString([]byte(settingsJsonContents))
-	dockerfileCommands := []string{
-		`RUN mkdir -p /opt/code-server/.vscode/User`,
-		`RUN echo '` + b64SettingsJsonContents + `' | base64 -d > /opt/code-server/.vscode/User/settings.json`,
+	path := options.GetUserDataDir() + "/User/settings.json"
+	if options.NoSettings {
+		return copyFileCommand(path, settingsJsonContents, files), nil
 	}
-	result := strings.Join(dockerfileCommands, "\n")
-	return result, nil
+	if contentsFromSync, err := repository.Get(ctx, "settings.json"); err == nil {
+		if contents, err := mergeSyncedSettings(settings, contentsFromSync, options); err != nil {
+			// fall back to the local settings rather than shipping a half merged settings.json
+			log.Printf("Ignoring synced settings.json: %s", err)
+		} else {
+			settingsJsonContents = contents
+		}
+	}
+
+	return copyFileCommand(path, settingsJsonContents, files), nil
 }
 
-func createKeybindingsJson(ctx context.Context, devcontainer DevContainer, repository Repository) (string, error) {
-	keybindingsJsonFilenames := [...]string{
-		"keybindings.json",
-		"keybindingsMac.json",
+var keybindingsJsonFilenames = []string{
+	"keybindings.json",
+	"keybindingsMac.json",
+}
+
+// fetchResult is the contents of a synced file or the error fetching it.
+type fetchResult struct {
+	contents string
+	err      error
+}
+
+// prefetchedRepository serves the files fetched beforehand and falls back to the repository for others.
+type prefetchedRepository struct {
+	repository Repository
+	results    map[string]fetchResult
+}
+
+func (r *prefetchedRepository) Get(ctx context.Context, filename string) (string, error) {
+	if result, ok := r.results[filename]; ok {
+		return result.contents, result.err
 	}
+	return r.repository.Get(ctx, filename)
+}
+
+// prefetch fetches the files concurrently so that the network latency is not serialized. Errors are
+// kept and returned by Get as the repository would.
+func prefetch(ctx context.Context, repository Repository, filenames []string) Repository {
+	results := make([]fetchResult, len(filenames))
+	var wg sync.WaitGroup
+	for i, filename := range filenames {
+		wg.Add(1)
+		go func(i int, filename string) {
+			defer wg.Done()
+			contents, err := repository.Get(ctx, filename)
+			results[i] = fetchResult{contents: contents, err: err}
+		}(i, filename)
+	}
+	wg.Wait()
 
+	prefetched := prefetchedRepository{repository: repository, results: map[string]fetchResult{}}
+	for i, filename := range filenames {
+		prefetched.results[filename] = results[i]
+	}
+	return &prefetched
+}
+
+func createKeybindingsJson(ctx context.Context, devcontainer DevContainer, repository Repository, options WrapOptions, files GeneratedFiles) (string, error) {
+	if options.NoKeybindings {
+		return "", nil
+	}
 	for _, filename := range keybindingsJsonFilenames {
 		if contentsFromSync, err := repository.Get(ctx, filename); err == nil {
 			if len(contentsFromSync) == 0 {
@@ -115,92 +533,293 @@ func createKeybindingsJson(ctx context.Context, devcontainer DevContainer, repos
 				continue
 			}
 
-			b64KeybindingsJsonContents := b64.StdEncoding.EncodeToString([]byte(keybindingsJsonContents))
-			dockerfileCommands := []string{
-				`RUN mkdir -p /opt/code-server/.vscode/User`,
-				`RUN echo '` + b64KeybindingsJsonContents + `' | base64 -d > /opt/code-server/.vscode/User/keybindings.json`,
-			}
-			result := strings.Join(dockerfileCommands, "\n")
-			return result, nil
+			return copyFileCommand(options.GetUserDataDir()+"/User/keybindings.json", keybindingsJsonContents, files), nil
 		}
 	}
 
 	return "", nil
 }
 
-func modifyCodeServerDirPermissions(ctx context.Context, devcontainer DevContainer) (string, error) {
-	return `RUN chmod -R o+wr /opt/code-server/`, nil
+var ownerPattern = regexp.MustCompile(`^([a-zA-Z_][a-zA-Z0-9_.-]*|[0-9]+(:[0-9]+)?)$`)
+
+// getCodeServerDirOwner returns the user who runs code-server, or an empty string if it is unknown at build time.
+func getCodeServerDirOwner(devcontainer DevContainer, options WrapOptions) (string, error) {
+	owner := options.CodeServerDirOwner
+	if owner == "" {
+		owner = devcontainer.RemoteUser
+	}
+	if owner == "" {
+		return "", nil
+	}
+	if !ownerPattern.MatchString(owner) {
+		return "", fmt.Errorf("%s is not a user name or uid which can own %s", owner, codeServerDir)
+	}
+	return owner, nil
+}
+
+var uidPattern = regexp.MustCompile(`^[0-9]+(:[0-9]+)?$`)
+
+// modifyCodeServerDirPermissions gives the code-server directories to the user who runs code-server so that
+// it can update extensions and settings, and clone the repository. They are made writable by anyone if the
+// user is unknown, or if remoteUser may not exist in the image as it is neither created nor given by uid.
+func modifyCodeServerDirPermissions(ctx context.Context, devcontainer DevContainer, options WrapOptions) (string, error) {
+	dirs := []string{codeServerDir}
+	for _, dir := range []string{options.GetUserDataDir(), options.GetExtensionsDir(), options.CloneFolder} {
+		if dir != "" && !strings.HasPrefix(dir, codeServerDir) {
+			dirs = append(dirs, dir)
+		}
+	}
+	for _, dir := range options.PersistedDirs {
+		dirs = append(dirs, options.GetUserDataDir()+"/"+dir)
+	}
+	target := strings.Join(dirs, " ")
+
+	modification := "chmod -R o+wr " + target
+	owner, err := getCodeServerDirOwner(devcontainer, options)
+	if err != nil {
+		log.Print(err)
+	} else if owner != "" {
+		chown := fmt.Sprintf("chown -R %s %s", owner, target)
+		if uidPattern.MatchString(owner) || (options.CreateRemoteUser && owner == devcontainer.RemoteUser) {
+			modification = chown
+		} else {
+			modification = fmt.Sprintf("if id -u %s >/dev/null 2>&1; then %s; else %s; fi", owner, chown, modification)
+		}
+	}
+	if 1 < len(dirs) {
+		// the relocated directories may not exist when no extension or setting is installed
+		return fmt.Sprintf(`RUN mkdir -p %s && %s`, target, modification), nil
+	}
+	return `RUN ` + modification, nil
+}
+
+// uniqueExtensions trims extension IDs, drops empty ones and removes duplicates keeping the first one.
+// Extension IDs are case insensitive.
+func uniqueExtensions(extensions []string) []string {
+	seen := map[string]bool{}
+	result := []string{}
+	for _, v := range extensions {
+		v = strings.TrimSpace(v)
+		key := strings.ToLower(v)
+		if v == "" || seen[key] {
+			continue
+		}
+		seen[key] = true
+		result = append(result, v)
+	}
+	return result
 }
 
-func installExtensions(ctx context.Context, devcontainer DevContainer) (string, error) {
+func installExtensions(ctx context.Context, devcontainer DevContainer, options WrapOptions) (string, error) {
+	if options.NoExtensions {
+		return "", nil
+	}
+	extensions := append([]string{}, devcontainer.Extensions...)
+	extensions = append(extensions, options.Extensions...)
+	if _, languagePack := resolveLocale(options.Locale); languagePack != "" {
+		extensions = append(extensions, languagePack)
+	}
+
 	commands := []string{}
-	for _, v := range devcontainer.Extensions {
-		commands = append(commands, fmt.Sprintf("RUN code-server --install-extension %s --extensions-dir /opt/code-server/.vscode/extensions/", v))
+	for _, v := range uniqueExtensions(extensions) {
+		commands = append(commands, fmt.Sprintf("code-server --install-extension %s --extensions-dir %s", v, options.GetExtensionsDir()))
+	}
+	if len(commands) == 0 {
+		return "", nil
 	}
 
-	result := strings.Join(commands, "\n")
+	// install all extensions in a single layer
+	separator := " && \\\n    "
+	if options.IgnoreExtensionErrors {
+		separator = " ; \\\n    "
+		commands = append(commands, "true")
+	}
+	result := "RUN " + strings.Join(commands, separator)
 	return result, nil
 }
 
-func createConfigYaml(ctx context.Context, container DevContainer) (string, error) {
-	return `RUN echo "auth: none" > /opt/code-server/config.yml`, nil
+var userNamePattern = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_.-]*$`)
+
+// createRemoteUser adds remoteUser to the image unless it already exists.
+// useradd is used on Debian and Red Hat based images and adduser on Alpine.
+func createRemoteUser(ctx context.Context, devcontainer DevContainer, options WrapOptions) (string, error) {
+	user := devcontainer.RemoteUser
+	if !options.CreateRemoteUser || user == "" {
+		return "", nil
+	}
+	if !userNamePattern.MatchString(user) {
+		return "", fmt.Errorf("remoteUser %s is not a user name which can be created", user)
+	}
+
+	return fmt.Sprintf("RUN id -u %[1]s >/dev/null 2>&1 || useradd -m %[1]s || adduser -D %[1]s", user), nil
 }
 
-func WrapDockerFile(devcontainer DevContainer, repository Repository) (string, error) {
-	ctx := context.Background()
+// createCodeServerInstallation returns the instructions installing code-server as CodeServerInstall says.
+func createCodeServerInstallation(ctx context.Context, options WrapOptions, files GeneratedFiles) (string, error) {
+	install := options.CodeServerInstall
+	switch {
+	case install == "":
+		return CodeServerInstall, nil
+	case install == "none":
+		return `RUN command -v code-server >/dev/null || { echo "code-server is not installed in the base image" >&2; exit 1; }`, nil
+	case strings.HasPrefix(install, "http://") || strings.HasPrefix(install, "https://"):
+		if u, err := url.Parse(install); err != nil || u.Host == "" {
+			return "", fmt.Errorf("Code Server install %s is not a valid URL", install)
+		}
+		return fmt.Sprintf("RUN curl -fsSL %s | sh", shellQuote(install)), nil
+	}
 
-	dockerfilePath := filepath.Join(devcontainer.DirPath, devcontainer.Build.Dockerfile)
-	dockerfile, err := ioutil.ReadFile(dockerfilePath)
-	if err != nil {
+	packageInstallers := map[string]string{".deb": "dpkg -i", ".rpm": "rpm -i"}
+	installer, ok := packageInstallers[filepath.Ext(install)]
+	if !ok {
+		return "", fmt.Errorf("Code Server install %s must be a URL, a .deb or .rpm package or none", install)
+	}
+	if _, err := os.Stat(install); err != nil {
 		return "", err
 	}
+	packagePath := "/tmp/" + filepath.Base(install)
+	return strings.Join([]string{
+		copyHostFileCommand(packagePath, install, files),
+		fmt.Sprintf("RUN %s %s && rm %s", installer, packagePath, packagePath),
+	}, "\n"), nil
+}
 
-	entryScriptCreation, err := createEntryScript(ctx, devcontainer)
+func createConfigYaml(ctx context.Context, container DevContainer, files GeneratedFiles) (string, error) {
+	return copyFileCommand("/opt/code-server/config.yml", "auth: none\n", files), nil
+}
+
+// Layers holds the already generated instructions which are appended to the base Dockerfile.
+type Layers struct {
+	Target                              string
+	RemoteUserCreation                  string
+	SettingJsonCreation                 string
+	KeybindingsJsonCreation             string
+	EntryScriptCreation                 string
+	ExtensionsInstallation              string
+	ConfigYamlCreation                  string
+	CodeServerDirPermissionModification string
+	// CodeServerInstallation installs code-server. CodeServerInstall is used when it is empty
+	CodeServerInstallation string
+	// KeepEntrypoint leaves ENTRYPOINT and CMD of the base image untouched
+	KeepEntrypoint bool
+}
+
+// AssembleDockerFile appends the code-server layers to the base Dockerfile content without any I/O.
+func AssembleDockerFile(dockerfile string, layers Layers) string {
+	if layers.Target != "" {
+		// put the code-server layers on top of the target stage instead of the last stage
+		dockerfile = strings.Join([]string{
+			dockerfile,
+			fmt.Sprintf("FROM %s AS %s", layers.Target, StageName),
+		}, "\n")
+	}
+
+	codeServerInstallation := layers.CodeServerInstallation
+	if codeServerInstallation == "" {
+		codeServerInstallation = CodeServerInstall
+	}
+	instructions := []string{
+		dockerfile,
+		codeServerInstallation,
+		layers.RemoteUserCreation,
+		layers.SettingJsonCreation,
+		layers.KeybindingsJsonCreation,
+		layers.EntryScriptCreation,
+		layers.ExtensionsInstallation,
+		layers.ConfigYamlCreation,
+		layers.CodeServerDirPermissionModification,
+	}
+	if !layers.KeepEntrypoint {
+		instructions = append(instructions, Entrypoint)
+	}
+
+	result := []string{}
+	for _, v := range instructions {
+		if v != "" {
+			result = append(result, v)
+		}
+	}
+	return strings.Join(result, "\n")
+}
+
+// WrapDockerFile returns the Dockerfile with the code-server layers and the files which must be
+// added to GeneratedDir of the build context. Fetching the synced settings is cancelled when ctx is done.
+func WrapDockerFile(ctx context.Context, devcontainer DevContainer, repository Repository, options WrapOptions) (string, GeneratedFiles, error) {
+	files := GeneratedFiles{}
+
+	dockerfile, err := ioutil.ReadFile(devcontainer.DockerfilePath())
 	if err != nil {
-		return "", err
+		return "", nil, err
+	}
+
+	codeServerInstallation, err := createCodeServerInstallation(ctx, options, files)
+	if err != nil {
+		return "", nil, err
 	}
 
-	extensionsInstallation, err := installExtensions(ctx, devcontainer)
+	entryScriptCreation, err := createEntryScript(ctx, devcontainer, options, files)
+	if err != nil {
+		return "", nil, err
+	}
+
+	extensionsInstallation, err := installExtensions(ctx, devcontainer, options)
 	if err != nil {
 		log.Print(err)
 		extensionsInstallation = ""
 	}
 
-	codeServerDirPermissionModification, err := modifyCodeServerDirPermissions(ctx, devcontainer)
+	codeServerDirPermissionModification, err := modifyCodeServerDirPermissions(ctx, devcontainer, options)
 	if err != nil {
 		log.Print(err)
 		codeServerDirPermissionModification = ""
 	}
 
-	configYamlCreation, err := createConfigYaml(ctx, devcontainer)
+	remoteUserCreation, err := createRemoteUser(ctx, devcontainer, options)
+	if err != nil {
+		return "", nil, err
+	}
+
+	configYamlCreation, err := createConfigYaml(ctx, devcontainer, files)
 	if err != nil {
 		log.Print(err)
 		configYamlCreation = ""
 	}
 
-	settingJsonCreation, err := createSettingJson(ctx, devcontainer, repository)
+	syncedFilenames := []string{}
+	if !options.NoSettings {
+		syncedFilenames = append(syncedFilenames, "settings.json")
+	}
+	if !options.NoKeybindings {
+		syncedFilenames = append(syncedFilenames, keybindingsJsonFilenames...)
+	}
+	repository = prefetch(ctx, repository, syncedFilenames)
+	// settings which failed to be fetched are skipped, but an interrupted build must not go on without them
+	if err := ctx.Err(); err != nil {
+		return "", nil, err
+	}
+	settingJsonCreation, err := createSettingJson(ctx, devcontainer, repository, options, files)
 	if err != nil {
 		log.Print(err)
 		settingJsonCreation = ""
 	}
 
-	keybindingsJsonCreation, err := createKeybindingsJson(ctx, devcontainer, repository)
+	keybindingsJsonCreation, err := createKeybindingsJson(ctx, devcontainer, repository, options, files)
 	if err != nil {
 		log.Print(err)
 		keybindingsJsonCreation = ""
 	}
 
-	dockerfileContent := string(dockerfile)
-	dockerfileContent = strings.Join([]string{
-		dockerfileContent,
-		CodeServerInstall,
-		settingJsonCreation,
-		keybindingsJsonCreation,
-		entryScriptCreation,
-		extensionsInstallation,
-		configYamlCreation,
-		codeServerDirPermissionModification,
-		Entrypoint}, "\n")
-
-	return dockerfileContent, nil
+	layers := Layers{
+		Target:                              devcontainer.Build.Target,
+		CodeServerInstallation:              codeServerInstallation,
+		RemoteUserCreation:                  remoteUserCreation,
+		SettingJsonCreation:                 settingJsonCreation,
+		KeybindingsJsonCreation:             keybindingsJsonCreation,
+		EntryScriptCreation:                 entryScriptCreation,
+		ExtensionsInstallation:              extensionsInstallation,
+		ConfigYamlCreation:                  configYamlCreation,
+		CodeServerDirPermissionModification: codeServerDirPermissionModification,
+		KeepEntrypoint:                      !devcontainer.ShouldOverrideCommand(),
+	}
+	return AssembleDockerFile(string(dockerfile), layers), files, nil
 }
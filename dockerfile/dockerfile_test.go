@@ -2,11 +2,18 @@ package dockerfile
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	. "github.com/ar90n/code-code-server/devcontainer"
 	"io/ioutil"
+	"math"
 	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 )
 
 type MemoryRepository struct {
@@ -33,7 +40,7 @@ func TestDockerfile(t *testing.T) {
 	devcontainer.Build.Context = "."
 
 	repository := MemoryRepository{data: map[string]string{}}
-	contents, err := WrapDockerFile(devcontainer, &repository)
+	contents, files, err := WrapDockerFile(context.Background(), devcontainer, &repository, WrapOptions{})
 
 	if err != nil {
 		t.Errorf("Error wrapping Dockerfile: %s", err)
@@ -41,17 +48,777 @@ func TestDockerfile(t *testing.T) {
 
 	expectDockerfileContents := `FROM golang:1.12.5
 RUN curl -fsSL https://code-server.dev/install.sh | sh
-RUN mkdir -p /opt/code-server/.vscode/User
-RUN echo 'e30K' | base64 -d > /opt/code-server/.vscode/User/settings.json
-
-RUN mkdir -p /opt/code-server
-RUN echo 'IyEvYmluL2Jhc2gKc2V0IC1lCnNldCAteAoKY29kZS1zZXJ2ZXIgLS11c2VyLWRhdGEtZGlyIC9vcHQvY29kZS1zZXJ2ZXIvLnZzY29kZSAtLWNvbmZpZyAvb3B0L2NvZGUtc2VydmVyL2NvbmZpZy55bWwgLS1iaW5kLWFkZHIgMC4wLjAuMDo4MDgw' | base64 -d > /opt/code-server/entrypoint.sh
+COPY .code-code-server/settings.json /opt/code-server/.vscode/User/settings.json
+COPY .code-code-server/entrypoint.sh /opt/code-server/entrypoint.sh
 RUN chmod +x /opt/code-server/entrypoint.sh
-
-RUN echo "auth: none" > /opt/code-server/config.yml
+COPY .code-code-server/config.yml /opt/code-server/config.yml
 RUN chmod -R o+wr /opt/code-server/
 ENTRYPOINT ["/opt/code-server/entrypoint.sh"]`
 	if contents != expectDockerfileContents {
 		t.Errorf("Expected Dockerfile contents to be %s, got %s", expectDockerfileContents, contents)
 	}
+
+	expectFiles := GeneratedFiles{
+		"settings.json": {Contents: "{}\n"},
+		"entrypoint.sh": {Contents: "#!/bin/sh\nif [ -z \"$BASH_VERSION\" ] && command -v bash >/dev/null 2>&1; then exec bash \"$0\" \"$@\"; fi\nset -e\neval \"$(\"${BASH:-sh}\" -lic 'export -p >&3' 3>&1 >/dev/null 2>&1 </dev/null)\" || true\nset -x\n\ncode-server --user-data-dir /opt/code-server/.vscode --config /opt/code-server/config.yml --bind-addr \"${CODE_CODE_SERVER_BIND_ADDR:-0.0.0.0:8080}\""},
+		"config.yml":    {Contents: "auth: none\n"},
+	}
+	if !reflect.DeepEqual(files, expectFiles) {
+		t.Errorf("Expected generated files to be %v, got %v", expectFiles, files)
+	}
+}
+
+func TestWaitFor(t *testing.T) {
+	postCreateCommand := "if [ ! -e /opt/code-server/.postCreateCommand.done ]; then\ngo mod download\ntouch /opt/code-server/.postCreateCommand.done\nfi"
+	cases := []struct {
+		waitFor  string
+		expected string
+	}{
+		{"", postCreateCommand},
+		{"postCreateCommand", postCreateCommand},
+		{"postStartCommand", postCreateCommand},
+		{"onCreateCommand", "(\n" + postCreateCommand + "\n) &"},
+	}
+
+	for _, c := range cases {
+		devcontainer := DevContainer{}
+		devcontainer.PostCreateCommand = "go mod download"
+		devcontainer.WaitFor = c.waitFor
+		entryScriptCommands, _ := createEntryScriptCommands(context.Background(), devcontainer, WrapOptions{StrictLifecycle: true})
+		postCreateCommand := entryScriptCommands[len(entryScriptCommands)-2]
+		if postCreateCommand != c.expected {
+			t.Errorf("Expected postCreateCommand with waitFor %s to be %s, got %s", c.waitFor, c.expected, postCreateCommand)
+		}
+	}
+}
+
+func TestTolerateLifecycleFailure(t *testing.T) {
+	devcontainer := DevContainer{UserEnvProbe: "none"}
+	devcontainer.PostCreateCommand = "false\necho unreachable"
+	entryScriptCommands, err := createEntryScriptCommands(context.Background(), devcontainer, WrapOptions{})
+	if err != nil {
+		t.Fatalf("Error creating entry script: %s", err)
+	}
+	// replace code-server with a marker
+	entryScriptCommands[len(entryScriptCommands)-1] = "echo started"
+	scriptPath := filepath.Join(t.TempDir(), "entrypoint.sh")
+	if err := ioutil.WriteFile(scriptPath, []byte(strings.Join(entryScriptCommands, "\n")), 0755); err != nil {
+		t.Fatalf("Error writing entry script: %s", err)
+	}
+
+	out, err := exec.Command("bash", scriptPath).CombinedOutput()
+	if err != nil {
+		t.Fatalf("Expected the entry script to go on after postCreateCommand failed, got %s: %s", err, out)
+	}
+	if !strings.Contains(string(out), "started") || !strings.Contains(string(out), "postCreateCommand failed with status 1") {
+		t.Errorf("Expected the failure to be logged and code-server to start, got %s", out)
+	}
+	if strings.Contains(string(out), "\nunreachable") {
+		t.Errorf("Expected postCreateCommand to stop at the first failure, got %s", out)
+	}
+
+	entryScriptCommands, err = createEntryScriptCommands(context.Background(), devcontainer, WrapOptions{StrictLifecycle: true})
+	if err != nil {
+		t.Fatalf("Error creating entry script with strict lifecycle: %s", err)
+	}
+	if strings.Contains(entryScriptCommands[len(entryScriptCommands)-2], "Starting code-server anyway") {
+		t.Errorf("Expected postCreateCommand not to tolerate failures with strict lifecycle, got %s", entryScriptCommands[len(entryScriptCommands)-2])
+	}
+}
+
+func TestRunPostCreateCommandOnce(t *testing.T) {
+	devcontainer := DevContainer{UserEnvProbe: "none"}
+	devcontainer.PostCreateCommand = "echo created"
+	entryScriptCommands, _ := createEntryScriptCommands(context.Background(), devcontainer, WrapOptions{})
+	marker := filepath.Join(t.TempDir(), "postCreateCommand.done")
+	entryScript := strings.ReplaceAll(strings.Join(entryScriptCommands[:len(entryScriptCommands)-1], "\n"), postCreateMarker, marker)
+
+	for i, expected := range []bool{true, false} {
+		out, err := exec.Command("bash", "-c", entryScript).CombinedOutput()
+		if err != nil {
+			t.Fatalf("Error running the entry script: %s: %s", err, out)
+		}
+		if strings.Contains(string(out), "\ncreated") != expected {
+			t.Errorf("Expected postCreateCommand to run on start %d: %v, got %s", i+1, expected, out)
+		}
+	}
+}
+
+func TestUserEnvProbe(t *testing.T) {
+	cases := []struct {
+		userEnvProbe string
+		expected     string
+	}{
+		{"", `"${BASH:-sh}" -lic `},
+		{"loginShell", `"${BASH:-sh}" -lc `},
+		{"interactiveShell", `"${BASH:-sh}" -ic `},
+	}
+	for _, c := range cases {
+		devcontainer := DevContainer{UserEnvProbe: c.userEnvProbe}
+		entryScriptCommands, err := createEntryScriptCommands(context.Background(), devcontainer, WrapOptions{})
+		if err != nil {
+			t.Errorf("Error creating entry script with userEnvProbe %s: %s", c.userEnvProbe, err)
+		}
+		if !strings.Contains(entryScriptCommands[3], c.expected) {
+			t.Errorf("Expected userEnvProbe %s to run %s, got %s", c.userEnvProbe, c.expected, entryScriptCommands[3])
+		}
+	}
+
+	devcontainer := DevContainer{UserEnvProbe: "none"}
+	entryScriptCommands, _ := createEntryScriptCommands(context.Background(), devcontainer, WrapOptions{})
+	if strings.Contains(strings.Join(entryScriptCommands, "\n"), "export -p") {
+		t.Errorf("Expected no environment probe with userEnvProbe none, got %v", entryScriptCommands)
+	}
+	if _, err := createEntryScriptCommands(context.Background(), DevContainer{UserEnvProbe: "zsh"}, WrapOptions{}); err == nil {
+		t.Errorf("Expected an error for an unknown userEnvProbe")
+	}
+}
+
+func TestEntrypointShell(t *testing.T) {
+	cases := []struct {
+		shell   string
+		shebang string
+		probe   string
+		fails   bool
+	}{
+		{"", "#!/bin/sh", `"${BASH:-sh}" -lic `, false},
+		{"sh", "#!/bin/sh", "/bin/sh -lic ", false},
+		{"/usr/bin/bash", "#!/usr/bin/bash", "/usr/bin/bash -lic ", false},
+		{"bash; rm -rf /", "", "", true},
+	}
+	for _, c := range cases {
+		commands, err := createEntryScriptCommands(context.Background(), DevContainer{}, WrapOptions{EntrypointShell: c.shell})
+		if (err != nil) != c.fails {
+			t.Errorf("Expected error of entrypoint shell %s to be %v, got %v", c.shell, c.fails, err)
+		}
+		if c.fails {
+			continue
+		}
+		script := strings.Join(commands, "\n")
+		if !strings.HasPrefix(script, c.shebang+"\n") || !strings.Contains(script, c.probe) {
+			t.Errorf("Expected entry script of shell %s to start with %s and probe with %s, got %s", c.shell, c.shebang, c.probe, script)
+		}
+	}
+}
+
+func TestResolveLocale(t *testing.T) {
+	cases := []struct {
+		locale       string
+		expected     string
+		languagePack string
+	}{
+		{"", "", ""},
+		{"C", "", ""},
+		{"C.UTF-8", "", ""},
+		{"POSIX", "", ""},
+		{"en_US.UTF-8", "", ""},
+		{"ja_JP.UTF-8", "ja", "MS-CEINTL.vscode-language-pack-ja"},
+		{"zh_CN.UTF-8", "zh-cn", "MS-CEINTL.vscode-language-pack-zh-hans"},
+		{"pt_BR", "pt-br", "MS-CEINTL.vscode-language-pack-pt-BR"},
+		{"fi_FI.UTF-8", "", ""},
+	}
+
+	for _, c := range cases {
+		locale, languagePack := resolveLocale(c.locale)
+		if locale != c.expected || languagePack != c.languagePack {
+			t.Errorf("Expected locale %s to resolve to (%s, %s), got (%s, %s)", c.locale, c.expected, c.languagePack, locale, languagePack)
+		}
+	}
+}
+
+func TestLocaleFallback(t *testing.T) {
+	cases := []struct {
+		locale       string
+		localeOption string
+		languagePack string
+	}{
+		{"ja_JP.UTF-8", "--locale ja", "MS-CEINTL.vscode-language-pack-ja"},
+		{"fi_FI.UTF-8", "", ""},
+		{"C.UTF-8", "", ""},
+	}
+	for _, c := range cases {
+		devcontainer := DevContainer{}
+		options := WrapOptions{Locale: c.locale}
+		entryScriptCommands, err := createEntryScriptCommands(context.Background(), devcontainer, options)
+		if err != nil {
+			t.Fatalf("Error creating entry script: %s", err)
+		}
+		codeServerCommand := entryScriptCommands[len(entryScriptCommands)-1]
+		if strings.Contains(codeServerCommand, "--locale") != (c.localeOption != "") || !strings.Contains(codeServerCommand, c.localeOption) {
+			t.Errorf("Expected code-server with locale %s to be given %q, got %s", c.locale, c.localeOption, codeServerCommand)
+		}
+
+		extensions, err := installExtensions(context.Background(), devcontainer, options)
+		if err != nil {
+			t.Fatalf("Error installing extensions: %s", err)
+		}
+		if (c.languagePack == "" && extensions != "") || !strings.Contains(extensions, c.languagePack) {
+			t.Errorf("Expected language pack of locale %s to be %q, got %s", c.locale, c.languagePack, extensions)
+		}
+	}
+}
+
+func TestDockerfileWithTarget(t *testing.T) {
+	tmpFile, _ := ioutil.TempFile("", "Dockerfile")
+	defer os.Remove(tmpFile.Name())
+
+	dockerfileContents := `FROM golang:1.12.5 AS dev
+FROM dev AS release`
+	tmpFile.WriteString(dockerfileContents)
+
+	devcontainer := DevContainer{}
+	devcontainer.Name = "test"
+	devcontainer.Build.Dockerfile = tmpFile.Name()
+	devcontainer.Build.Target = "dev"
+
+	repository := MemoryRepository{data: map[string]string{}}
+	contents, _, err := WrapDockerFile(context.Background(), devcontainer, &repository, WrapOptions{})
+	if err != nil {
+		t.Errorf("Error wrapping Dockerfile: %s", err)
+	}
+
+	expectPrefix := dockerfileContents + `
+FROM dev AS code-code-server
+RUN curl -fsSL https://code-server.dev/install.sh | sh`
+	if !strings.HasPrefix(contents, expectPrefix) {
+		t.Errorf("Expected Dockerfile contents to start with %s, got %s", expectPrefix, contents)
+	}
+}
+
+func TestAssembleDockerFile(t *testing.T) {
+	layers := Layers{
+		SettingJsonCreation:                 "# settings",
+		KeybindingsJsonCreation:             "# keybindings",
+		EntryScriptCreation:                 "# entry script",
+		ExtensionsInstallation:              "# extensions",
+		ConfigYamlCreation:                  "# config",
+		CodeServerDirPermissionModification: "# permission",
+	}
+	contents := AssembleDockerFile("FROM golang:1.12.5", layers)
+
+	expectDockerfileContents := `FROM golang:1.12.5
+RUN curl -fsSL https://code-server.dev/install.sh | sh
+# settings
+# keybindings
+# entry script
+# extensions
+# config
+# permission
+ENTRYPOINT ["/opt/code-server/entrypoint.sh"]`
+	if contents != expectDockerfileContents {
+		t.Errorf("Expected Dockerfile contents to be %s, got %s", expectDockerfileContents, contents)
+	}
+}
+
+func TestCodeServerInstallation(t *testing.T) {
+	dir := t.TempDir()
+	packagePath := filepath.Join(dir, "code-server_4.1.0_amd64.deb")
+	if err := ioutil.WriteFile(packagePath, []byte("deb"), 0644); err != nil {
+		t.Fatalf("Error writing package: %s", err)
+	}
+
+	cases := []struct {
+		install  string
+		expected string
+	}{
+		{"", CodeServerInstall},
+		{"https://mirror.example.com/install.sh", "RUN curl -fsSL 'https://mirror.example.com/install.sh' | sh"},
+		{"https://mirror.example.com/install.sh?version=4.1.0&arch=amd64", "RUN curl -fsSL 'https://mirror.example.com/install.sh?version=4.1.0&arch=amd64' | sh"},
+		{"none", `RUN command -v code-server >/dev/null || { echo "code-server is not installed in the base image" >&2; exit 1; }`},
+		{packagePath, "COPY .code-code-server/code-server_4.1.0_amd64.deb /tmp/code-server_4.1.0_amd64.deb\nRUN dpkg -i /tmp/code-server_4.1.0_amd64.deb && rm /tmp/code-server_4.1.0_amd64.deb"},
+	}
+	for _, c := range cases {
+		files := GeneratedFiles{}
+		installation, err := createCodeServerInstallation(context.Background(), WrapOptions{CodeServerInstall: c.install}, files)
+		if err != nil {
+			t.Errorf("Error creating code-server installation for %s: %s", c.install, err)
+		}
+		if installation != c.expected {
+			t.Errorf("Expected code-server installation for %s to be %s, got %s", c.install, c.expected, installation)
+		}
+	}
+
+	files := GeneratedFiles{}
+	createCodeServerInstallation(context.Background(), WrapOptions{CodeServerInstall: packagePath}, files)
+	if files["code-server_4.1.0_amd64.deb"].HostPath != packagePath {
+		t.Errorf("Expected the package to be added to the build context, got %v", files)
+	}
+	for _, install := range []string{"code-server.tar.gz", filepath.Join(dir, "missing.rpm"), "https://", "https://mirror example.com/install.sh"} {
+		if _, err := createCodeServerInstallation(context.Background(), WrapOptions{CodeServerInstall: install}, GeneratedFiles{}); err == nil {
+			t.Errorf("Expected an error for code-server install %s", install)
+		}
+	}
+}
+
+func TestKeepEntrypoint(t *testing.T) {
+	overrideCommand := false
+	devcontainer := DevContainer{}
+	devcontainer.OverrideCommand = &overrideCommand
+
+	entryScriptCommands, _ := createEntryScriptCommands(context.Background(), devcontainer, WrapOptions{})
+	codeServerCommand := entryScriptCommands[len(entryScriptCommands)-2]
+	if !strings.HasPrefix(codeServerCommand, "code-server ") || !strings.HasSuffix(codeServerCommand, " &") {
+		t.Errorf("Expected code-server to run in the background, got %s", codeServerCommand)
+	}
+
+	contents := AssembleDockerFile("FROM nginx", Layers{KeepEntrypoint: true})
+	if strings.Contains(contents, "ENTRYPOINT") {
+		t.Errorf("Expected ENTRYPOINT of the base image to be kept, got %s", contents)
+	}
+}
+
+func TestInstallExtensions(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.Extensions = []string{"golang.Go", " ms-python.python ", "", "golang.go", "golang.Go"}
+
+	contents, err := installExtensions(context.Background(), devcontainer, WrapOptions{})
+	if err != nil {
+		t.Errorf("Error installing extensions: %s", err)
+	}
+
+	expectContents := `RUN code-server --install-extension golang.Go --extensions-dir /opt/code-server/.vscode/extensions/ && \
+    code-server --install-extension ms-python.python --extensions-dir /opt/code-server/.vscode/extensions/`
+	if contents != expectContents {
+		t.Errorf("Expected extensions installation to be %s, got %s", expectContents, contents)
+	}
+
+	contents, err = installExtensions(context.Background(), devcontainer, WrapOptions{IgnoreExtensionErrors: true})
+	if err != nil {
+		t.Errorf("Error installing extensions: %s", err)
+	}
+
+	expectContents = `RUN code-server --install-extension golang.Go --extensions-dir /opt/code-server/.vscode/extensions/ ; \
+    code-server --install-extension ms-python.python --extensions-dir /opt/code-server/.vscode/extensions/ ; \
+    true`
+	if contents != expectContents {
+		t.Errorf("Expected extensions installation to be %s, got %s", expectContents, contents)
+	}
+}
+
+func TestCreateRemoteUser(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.RemoteUser = "vscode"
+
+	contents, err := createRemoteUser(context.Background(), devcontainer, WrapOptions{})
+	if err != nil || contents != "" {
+		t.Errorf("Expected no remote user creation without the option, got %s, %v", contents, err)
+	}
+
+	contents, err = createRemoteUser(context.Background(), devcontainer, WrapOptions{CreateRemoteUser: true})
+	if err != nil {
+		t.Errorf("Error creating remote user: %s", err)
+	}
+	expectContents := `RUN id -u vscode >/dev/null 2>&1 || useradd -m vscode || adduser -D vscode`
+	if contents != expectContents {
+		t.Errorf("Expected remote user creation to be %s, got %s", expectContents, contents)
+	}
+
+	devcontainer.RemoteUser = "vscode; rm -rf /"
+	if _, err := createRemoteUser(context.Background(), devcontainer, WrapOptions{CreateRemoteUser: true}); err == nil {
+		t.Errorf("Expected an error for an invalid user name")
+	}
+}
+
+func TestRemoteEnv(t *testing.T) {
+	remoteEnv := map[string]string{
+		"PATH":      "${containerEnv:PATH}:/extra",
+		"GOPATH":    "${containerEnv:GOPATH:/go}/bin",
+		"HOST_HOME": "${localEnv:HOME}",
+		"TOKEN":     "${localEnv:TOKEN}",
+		"EDITOR":    "${localEnv:EDITOR:vim}",
+		"PRICE":     "`$5`",
+	}
+	commands, err := remoteEnvCommands(remoteEnv)
+	if err != nil {
+		t.Fatalf("Error creating remoteEnv commands: %s", err)
+	}
+	expected := []string{
+		`export EDITOR="${CODE_CODE_SERVER_LOCAL_ENV_EDITOR:-vim}"`,
+		`export GOPATH="${GOPATH:-/go}/bin"`,
+		`export HOST_HOME="${CODE_CODE_SERVER_LOCAL_ENV_HOME}"`,
+		`export PATH="${PATH}:/extra"`,
+		"export PRICE=\"\\`\\$5\\`\"",
+		`export TOKEN="${CODE_CODE_SERVER_LOCAL_ENV_TOKEN}"`,
+	}
+	if !reflect.DeepEqual(commands, expected) {
+		t.Errorf("Expected remoteEnv commands to be %v, got %v", expected, commands)
+	}
+	if script := strings.Join(commands, "\n"); strings.Contains(script, "/home/user") {
+		t.Errorf("Expected the host environment not to be written in the entry script, got %s", script)
+	}
+
+	if _, err := remoteEnvCommands(map[string]string{"A-B": "c"}); err == nil {
+		t.Errorf("Expected an error for an invalid variable name")
+	}
+
+	getenv := func(name string) string {
+		return map[string]string{"HOME": "/home/user", "TOKEN": `a"b$c`}[name]
+	}
+	localEnv := RemoteEnvLocalEnv(remoteEnv, getenv)
+	expectedLocalEnv := []string{
+		"CODE_CODE_SERVER_LOCAL_ENV_EDITOR=",
+		"CODE_CODE_SERVER_LOCAL_ENV_HOME=/home/user",
+		`CODE_CODE_SERVER_LOCAL_ENV_TOKEN=a"b$c`,
+	}
+	if !reflect.DeepEqual(localEnv, expectedLocalEnv) {
+		t.Errorf("Expected the host variables of remoteEnv to be %v, got %v", expectedLocalEnv, localEnv)
+	}
+
+	// the container is started with the host variables as docker run -e does
+	cmd := exec.Command("sh", "-c", "PATH=/usr/bin\nunset GOPATH\n"+strings.Join(commands, "\n")+"\necho \"$PATH $GOPATH $HOST_HOME $TOKEN $EDITOR $PRICE\"")
+	cmd.Env = append(os.Environ(), localEnv...)
+	script, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("Error running remoteEnv commands: %s", err)
+	}
+	if out := strings.TrimSpace(string(script)); out != "/usr/bin:/extra /go/bin /home/user a\"b$c vim `$5`" {
+		t.Errorf("Expected remoteEnv to resolve against the container environment, got %s", out)
+	}
+}
+
+func TestCloneRepository(t *testing.T) {
+	devcontainer := DevContainer{PostCreateCommand: "go mod download"}
+	options := WrapOptions{CloneRepository: "https://github.com/ar90n/code-code-server", CloneFolder: "/workspace/project"}
+
+	commands, err := createEntryScriptCommands(context.Background(), devcontainer, options)
+	if err != nil {
+		t.Fatalf("Error creating entry script: %s", err)
+	}
+	script := strings.Join(commands, "\n")
+	clone := `if [ -z "$(ls -A '/workspace/project')" ]; then git clone 'https://github.com/ar90n/code-code-server' '/workspace/project'; fi`
+	if i := strings.Index(script, clone); i < 0 || strings.Index(script, "go mod download") < i {
+		t.Errorf("Expected the repository to be cloned before postCreateCommand, got %s", script)
+	}
+
+	expected := "RUN mkdir -p /opt/code-server/ /workspace/project && chmod -R o+wr /opt/code-server/ /workspace/project"
+	if permissions, _ := modifyCodeServerDirPermissions(context.Background(), devcontainer, options); permissions != expected {
+		t.Errorf("Expected permission modification to be %s, got %s", expected, permissions)
+	}
+}
+
+func TestCodeServerDirPermissions(t *testing.T) {
+	cases := []struct {
+		remoteUser       string
+		createRemoteUser bool
+		owner            string
+		expected         string
+	}{
+		{"", false, "", "RUN chmod -R o+wr /opt/code-server/"},
+		{"vscode", true, "", "RUN chown -R vscode /opt/code-server/"},
+		// remoteUser may not exist in the image, which would fail chown
+		{"vscode", false, "", "RUN if id -u vscode >/dev/null 2>&1; then chown -R vscode /opt/code-server/; else chmod -R o+wr /opt/code-server/; fi"},
+		{"vscode", false, "1000:1000", "RUN chown -R 1000:1000 /opt/code-server/"},
+		{"${localEnv:USER}", false, "", "RUN chmod -R o+wr /opt/code-server/"},
+	}
+	for _, c := range cases {
+		devcontainer := DevContainer{RemoteUser: c.remoteUser}
+		options := WrapOptions{CreateRemoteUser: c.createRemoteUser, CodeServerDirOwner: c.owner}
+		contents, err := modifyCodeServerDirPermissions(context.Background(), devcontainer, options)
+		if err != nil {
+			t.Fatalf("Error modifying permissions: %s", err)
+		}
+		if contents != c.expected {
+			t.Errorf("Expected permission modification to be %s, got %s", c.expected, contents)
+		}
+	}
+}
+
+func TestPersistedDirsPermissions(t *testing.T) {
+	devcontainer := DevContainer{RemoteUser: "vscode"}
+	options := WrapOptions{CreateRemoteUser: true, PersistedDirs: []string{"User/globalStorage", "User/workspaceStorage"}}
+	contents, err := modifyCodeServerDirPermissions(context.Background(), devcontainer, options)
+	if err != nil {
+		t.Fatalf("Error modifying permissions: %s", err)
+	}
+	expected := "RUN mkdir -p /opt/code-server/ /opt/code-server/.vscode/User/globalStorage /opt/code-server/.vscode/User/workspaceStorage && chown -R vscode /opt/code-server/ /opt/code-server/.vscode/User/globalStorage /opt/code-server/.vscode/User/workspaceStorage"
+	if contents != expected {
+		t.Errorf("Expected permission modification to be %s, got %s", expected, contents)
+	}
+}
+
+func TestCodeServerDirPermissionsMissingUser(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "code-server")
+	options := WrapOptions{CloneFolder: dir}
+	devcontainer := DevContainer{RemoteUser: "code-code-server-missing-user"}
+	contents, err := modifyCodeServerDirPermissions(context.Background(), devcontainer, options)
+	if err != nil {
+		t.Fatalf("Error modifying permissions: %s", err)
+	}
+
+	// run the instruction on the directory of the test instead of /opt/code-server/
+	command := strings.ReplaceAll(strings.TrimPrefix(contents, "RUN "), "/opt/code-server/ ", "")
+	if out, err := exec.Command("sh", "-c", command).CombinedOutput(); err != nil {
+		t.Fatalf("Expected the missing user to fall back to chmod, got %s: %s", err, out)
+	}
+	info, err := os.Stat(dir)
+	if err != nil {
+		t.Fatalf("Error checking %s: %s", dir, err)
+	}
+	if info.Mode().Perm()&0006 != 0006 {
+		t.Errorf("Expected %s to be writable by anyone, got %s", dir, info.Mode())
+	}
+}
+
+func TestUserDataDirOverride(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.Extensions = []string{"golang.Go"}
+	repository := MemoryRepository{data: map[string]string{
+		"keybindings.json": `[{"key": "ctrl+k", "command": "noop"}]`,
+	}}
+	options := WrapOptions{UserDataDir: "/data/code-server", ExtensionsDir: "/data/extensions"}
+	ctx := context.Background()
+
+	settings, err := createSettingJson(ctx, devcontainer, &repository, options, GeneratedFiles{})
+	if err != nil {
+		t.Fatalf("Error creating settings.json: %s", err)
+	}
+	keybindings, err := createKeybindingsJson(ctx, devcontainer, &repository, options, GeneratedFiles{})
+	if err != nil {
+		t.Fatalf("Error creating keybindings.json: %s", err)
+	}
+	entryScriptCommands, err := createEntryScriptCommands(ctx, devcontainer, options)
+	if err != nil {
+		t.Fatalf("Error creating entry script: %s", err)
+	}
+	extensions, err := installExtensions(ctx, devcontainer, options)
+	if err != nil {
+		t.Fatalf("Error installing extensions: %s", err)
+	}
+	permissions, err := modifyCodeServerDirPermissions(ctx, devcontainer, options)
+	if err != nil {
+		t.Fatalf("Error modifying permissions: %s", err)
+	}
+
+	layers := map[string]string{
+		"settings":    settings,
+		"keybindings": keybindings,
+		"entrypoint":  strings.Join(entryScriptCommands, "\n"),
+		"extensions":  extensions,
+		"permissions": permissions,
+	}
+	for name, layer := range layers {
+		if strings.Contains(layer, "/opt/code-server/.vscode") {
+			t.Errorf("Expected %s layer not to use the default user data dir, got %s", name, layer)
+		}
+	}
+
+	for _, layer := range []string{settings, keybindings, layers["entrypoint"], permissions} {
+		if !strings.Contains(layer, "/data/code-server") {
+			t.Errorf("Expected layer to use the overridden user data dir, got %s", layer)
+		}
+	}
+	for _, layer := range []string{layers["entrypoint"], extensions, permissions} {
+		if !strings.Contains(layer, "/data/extensions") {
+			t.Errorf("Expected layer to use the overridden extensions dir, got %s", layer)
+		}
+	}
+}
+
+func TestSettingsPrecedence(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.Settings = map[string]interface{}{"editor.fontSize": 12.0, "go.gopath": "/go"}
+	repository := MemoryRepository{data: map[string]string{
+		"settings.json": `{"editor.fontSize": 14, "editor.tabSize": 4}`,
+	}}
+
+	cases := []struct {
+		options  WrapOptions
+		expected string
+	}{
+		{WrapOptions{}, `{"editor.fontSize": 14, "editor.tabSize": 4, "go.gopath": "/go"}`},
+		{WrapOptions{PreferLocalSettings: true}, `{"editor.fontSize": 12, "editor.tabSize": 4, "go.gopath": "/go"}`},
+	}
+
+	for _, c := range cases {
+		files := GeneratedFiles{}
+		if _, err := createSettingJson(context.Background(), devcontainer, &repository, c.options, files); err != nil {
+			t.Errorf("Error creating settings.json: %s", err)
+		}
+		expectContents, _ := dumpAsJson(mustUnmarshal(c.expected))
+		if files["settings.json"].Contents != expectContents {
+			t.Errorf("Expected settings.json to be %s with %+v, got %s", expectContents, c.options, files["settings.json"].Contents)
+		}
+	}
+
+	if devcontainer.Settings["editor.fontSize"] != 12.0 {
+		t.Errorf("Expected local settings not to be modified, got %v", devcontainer.Settings)
+	}
+}
+
+func TestBrokenSyncedSettings(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.Settings = map[string]interface{}{"go.gopath": "/go"}
+	expectContents, _ := dumpAsJson(devcontainer.Settings)
+
+	// NaN is valid in JSON5 but cannot be encoded into settings.json
+	for _, contentsFromSync := range []string{`{"editor.fontSize": NaN}`, `{"editor.fontSize": `} {
+		repository := MemoryRepository{data: map[string]string{"settings.json": contentsFromSync}}
+		files := GeneratedFiles{}
+		if _, err := createSettingJson(context.Background(), devcontainer, &repository, WrapOptions{}, files); err != nil {
+			t.Errorf("Error creating settings.json: %s", err)
+		}
+		if files["settings.json"].Contents != expectContents {
+			t.Errorf("Expected settings.json to fall back to the local settings with %s, got %s", contentsFromSync, files["settings.json"].Contents)
+		}
+	}
+
+	if _, err := dumpAsJson(map[string]interface{}{"editor.fontSize": math.NaN()}); err == nil {
+		t.Errorf("Expected an error when encoding NaN")
+	}
+}
+
+func mustUnmarshal(contents string) map[string]interface{} {
+	var obj map[string]interface{}
+	if err := json.Unmarshal([]byte(contents), &obj); err != nil {
+		panic(err)
+	}
+	return obj
+}
+
+func TestLargeSettings(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.Settings = map[string]interface{}{}
+	for i := 0; i < 1000; i++ {
+		devcontainer.Settings[fmt.Sprintf("extension%d.setting", i)] = strings.Repeat("x", 32)
+	}
+	repository := MemoryRepository{data: map[string]string{}}
+
+	files := GeneratedFiles{}
+	contents, err := createSettingJson(context.Background(), devcontainer, &repository, WrapOptions{}, files)
+	if err != nil {
+		t.Errorf("Error creating settings.json: %s", err)
+	}
+
+	expectContents := `COPY .code-code-server/settings.json /opt/code-server/.vscode/User/settings.json`
+	if contents != expectContents {
+		t.Errorf("Expected settings.json creation to be %s, got %s", expectContents, contents)
+	}
+
+	// the settings are far larger than a line of the Dockerfile could hold
+	settingsJson := files["settings.json"].Contents
+	if len(settingsJson) < 32*1024 {
+		t.Errorf("Expected settings.json to hold all the settings, got %d bytes", len(settingsJson))
+	}
+	settings := map[string]interface{}{}
+	if err := json.Unmarshal([]byte(settingsJson), &settings); err != nil {
+		t.Fatalf("Error parsing settings.json: %s", err)
+	}
+	if !reflect.DeepEqual(settings, devcontainer.Settings) {
+		t.Errorf("Expected settings.json to hold the settings intact, got %d of %d settings", len(settings), len(devcontainer.Settings))
+	}
+}
+
+type slowRepository struct {
+	delay time.Duration
+	data  map[string]string
+}
+
+func (r *slowRepository) Get(ctx context.Context, filename string) (string, error) {
+	time.Sleep(r.delay)
+	if contents, ok := r.data[filename]; ok {
+		return contents, nil
+	}
+	return "", fmt.Errorf("%s is not found", filename)
+}
+
+func TestPrefetch(t *testing.T) {
+	repository := slowRepository{delay: 100 * time.Millisecond, data: map[string]string{"settings.json": "{}"}}
+	start := time.Now()
+	prefetched := prefetch(context.Background(), &repository, []string{"settings.json", "keybindings.json", "keybindingsMac.json"})
+	if elapsed := time.Since(start); 250*time.Millisecond < elapsed {
+		t.Errorf("Expected the files to be fetched concurrently, took %s", elapsed)
+	}
+
+	if contents, err := prefetched.Get(context.Background(), "settings.json"); err != nil || contents != "{}" {
+		t.Errorf("Expected settings.json to be {}, got %s, %v", contents, err)
+	}
+	if _, err := prefetched.Get(context.Background(), "keybindings.json"); err == nil {
+		t.Errorf("Expected an error for keybindings.json which is not found")
+	}
+}
+
+func TestWrapDockerFileCancelled(t *testing.T) {
+	dockerfilePath := filepath.Join(t.TempDir(), "Dockerfile")
+	if err := ioutil.WriteFile(dockerfilePath, []byte("FROM golang:1.12.5"), 0644); err != nil {
+		t.Fatalf("Error writing Dockerfile: %s", err)
+	}
+	devcontainer := DevContainer{}
+	devcontainer.Build.Dockerfile = dockerfilePath
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	repository := MemoryRepository{data: map[string]string{}}
+	if _, _, err := WrapDockerFile(ctx, devcontainer, &repository, WrapOptions{}); err != context.Canceled {
+		t.Errorf("Expected error to be %s, got %v", context.Canceled, err)
+	}
+}
+
+func TestSkipLayers(t *testing.T) {
+	devcontainer := DevContainer{Extensions: []string{"golang.Go"}}
+	devcontainer.Settings = map[string]interface{}{"go.gopath": "/go"}
+	repository := MemoryRepository{data: map[string]string{
+		"settings.json":    `{"editor.tabSize": 4}`,
+		"keybindings.json": `[{"key": "ctrl+k", "command": "editor.action.deleteLines"}]`,
+	}}
+	options := WrapOptions{NoExtensions: true, NoSettings: true, NoKeybindings: true, Locale: "ja"}
+
+	if extensions, _ := installExtensions(context.Background(), devcontainer, options); extensions != "" {
+		t.Errorf("Expected no extensions to be installed, got %s", extensions)
+	}
+	if keybindings, _ := createKeybindingsJson(context.Background(), devcontainer, &repository, options, GeneratedFiles{}); keybindings != "" {
+		t.Errorf("Expected no keybindings to be created, got %s", keybindings)
+	}
+	files := GeneratedFiles{}
+	createSettingJson(context.Background(), devcontainer, &repository, options, files)
+	if expected := "{\n  \"go.gopath\": \"/go\"\n}\n"; files["settings.json"].Contents != expected {
+		t.Errorf("Expected only the local settings, got %s", files["settings.json"].Contents)
+	}
+}
+
+func TestExtensionsOption(t *testing.T) {
+	devcontainer := DevContainer{Extensions: []string{"golang.Go"}}
+	options := WrapOptions{Extensions: []string{"golang.go", "eamodio.gitlens"}}
+	extensions, _ := installExtensions(context.Background(), devcontainer, options)
+	expected := "RUN code-server --install-extension golang.Go --extensions-dir /opt/code-server/.vscode/extensions/ && \\\n    code-server --install-extension eamodio.gitlens --extensions-dir /opt/code-server/.vscode/extensions/"
+	if extensions != expected {
+		t.Errorf("Expected extensions installation to be %s, got %s", expected, extensions)
+	}
+}
+
+func TestProjectSettings(t *testing.T) {
+	projectDirPath := t.TempDir()
+	os.Mkdir(filepath.Join(projectDirPath, ".vscode"), 0755)
+	ioutil.WriteFile(filepath.Join(projectDirPath, ".vscode", "settings.json"), []byte(`{
+		// comments are allowed as VS Code does
+		"editor.tabSize": 2,
+		"go.gopath": "/home/user/go",
+	}`), 0644)
+
+	devcontainer := DevContainer{DirPath: filepath.Join(projectDirPath, ".devcontainer")}
+	devcontainer.Settings = map[string]interface{}{"go.gopath": "/go"}
+	repository := MemoryRepository{data: map[string]string{"settings.json": `{"editor.fontSize": 16}`}}
+
+	cases := []struct {
+		options  WrapOptions
+		expected map[string]interface{}
+	}{
+		{WrapOptions{}, map[string]interface{}{"editor.tabSize": float64(2), "go.gopath": "/go", "editor.fontSize": float64(16)}},
+		{WrapOptions{NoProjectSettings: true}, map[string]interface{}{"go.gopath": "/go", "editor.fontSize": float64(16)}},
+	}
+	for _, c := range cases {
+		files := GeneratedFiles{}
+		createSettingJson(context.Background(), devcontainer, &repository, c.options, files)
+		var settings map[string]interface{}
+		json.Unmarshal([]byte(files["settings.json"].Contents), &settings)
+		if !reflect.DeepEqual(settings, c.expected) {
+			t.Errorf("Expected settings with %+v to be %v, got %v", c.options, c.expected, settings)
+		}
+	}
+
+	// a project without .vscode/settings.json
+	devcontainer.DirPath = filepath.Join(t.TempDir(), ".devcontainer")
+	files := GeneratedFiles{}
+	if _, err := createSettingJson(context.Background(), devcontainer, &MemoryRepository{data: map[string]string{}}, WrapOptions{}, files); err != nil {
+		t.Errorf("Error creating settings.json without .vscode/settings.json: %s", err)
+	}
 }
@@ -0,0 +1,99 @@
+package project
+
+import (
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+const (
+	Docker = "docker"
+	Podman = "podman"
+)
+
+// engine is the CLI of the container engine which builds and runs the containers.
+var engine = Docker
+
+// engineBinary is the path of the engine CLI if it is not the engine name in PATH.
+var engineBinary string
+
+// lookPath finds the engine CLI. Tests replace it to pretend which engines are installed.
+var lookPath = exec.LookPath
+
+// Engine returns the container engine in use.
+func Engine() string {
+	return engine
+}
+
+// SetEngine selects docker or podman as the container engine. An empty name selects the one installed,
+// preferring docker when both are, or docker when the binary is given by SetEngineBinary.
+func SetEngine(name string) error {
+	switch name {
+	case Docker, Podman:
+		engine = name
+		return nil
+	case "":
+		if engineBinary != "" {
+			engine = Docker
+			return nil
+		}
+		engine = detectEngine()
+		return nil
+	}
+	return fmt.Errorf("Engine must be docker or podman, got %s", name)
+}
+
+func detectEngine() string {
+	if _, err := lookPath(Docker); err == nil {
+		return Docker
+	}
+	if _, err := lookPath(Podman); err == nil {
+		return Podman
+	}
+	// let the missing docker be reported when it is run
+	return Docker
+}
+
+// EngineBinary returns the command which runs the container engine.
+func EngineBinary() string {
+	if engineBinary != "" {
+		return engineBinary
+	}
+	return engine
+}
+
+// SetEngineBinary overrides the command of the container engine, such as docker.io or a docker installed
+// out of PATH. An empty path runs the engine by its name.
+func SetEngineBinary(path string) {
+	engineBinary = path
+}
+
+// isPodman reports whether the containers run on podman, which differs from docker in the output of
+// info and in rootless user namespaces.
+func isPodman() bool {
+	return engine == Podman
+}
+
+// infoFormat returns the template of docker info or the equivalent one of podman info.
+func infoFormat(dockerFormat string, podmanFormat string) string {
+	if isPodman() {
+		return podmanFormat
+	}
+	return dockerFormat
+}
+
+// isRootlessPodman reports whether podman runs the containers without root. Rootful podman rejects
+// --userns=keep-id.
+func isRootlessPodman() bool {
+	out, err := execCommand(EngineBinary(), "info", "--format", "{{.Host.Security.Rootless}}").Output()
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// getEngineRunArgs returns the args which make podman behave as docker does for the dev container.
+// Rootless podman maps root in the container to the user, so the user is kept to own the workspace.
+func getEngineRunArgs(rootless func() bool) []string {
+	if isPodman() && rootless() {
+		return []string{"--userns=keep-id"}
+	}
+	return nil
+}
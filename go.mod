@@ -5,15 +5,15 @@ go 1.17
 require (
 	github.com/buildkite/interpolate v0.0.0-20200526001904-07f35b4ae251
 	github.com/flynn/json5 v0.0.0-20160717195620-7620272ed633
+	github.com/google/go-github/v43 v43.0.0
+	github.com/imdario/mergo v0.3.12
 	github.com/urfave/cli/v2 v2.3.0
 )
 
 require (
 	github.com/cpuguy83/go-md2man/v2 v2.0.0-20190314233015-f79a8a8ca69d // indirect
 	github.com/golang/protobuf v1.4.2 // indirect
-	github.com/google/go-github/v43 v43.0.0 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
-	github.com/imdario/mergo v0.3.12 // indirect
 	github.com/kylelemons/godebug v1.1.0 // indirect
 	github.com/robertkrimen/otto v0.0.0-20211024170158-b87d35c0b86f // indirect
 	github.com/russross/blackfriday/v2 v2.0.1 // indirect
@@ -0,0 +1,82 @@
+package project
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const DefaultBaseImage = "mcr.microsoft.com/vscode/devcontainers/base:bullseye"
+
+type InitOptions struct {
+	Name       string
+	Image      string
+	Extensions []string
+	Force      bool
+}
+
+type scaffoldBuild struct {
+	Dockerfile string `json:"dockerfile"`
+}
+
+type scaffold struct {
+	Name       string        `json:"name"`
+	Build      scaffoldBuild `json:"build"`
+	Extensions []string      `json:"extensions"`
+}
+
+// InitProject writes a minimal .devcontainer/devcontainer.json and Dockerfile into the project directory.
+func InitProject(projectDirPath string, options InitOptions) error {
+	absProjectDirPath, err := filepath.Abs(projectDirPath)
+	if err != nil {
+		return err
+	}
+
+	name := options.Name
+	if name == "" {
+		name = filepath.Base(absProjectDirPath)
+	}
+	image := options.Image
+	if image == "" {
+		image = DefaultBaseImage
+	}
+	extensions := options.Extensions
+	if extensions == nil {
+		extensions = []string{}
+	}
+
+	devcontainerJson, err := json.MarshalIndent(scaffold{
+		Name:       name,
+		Build:      scaffoldBuild{Dockerfile: "Dockerfile"},
+		Extensions: extensions,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	devcontainerDirPath := filepath.Join(absProjectDirPath, ".devcontainer")
+	files := map[string]string{
+		filepath.Join(devcontainerDirPath, "devcontainer.json"): string(devcontainerJson) + "\n",
+		filepath.Join(devcontainerDirPath, "Dockerfile"):        fmt.Sprintf("FROM %s\n", image),
+	}
+
+	if !options.Force {
+		for path := range files {
+			if _, err := os.Stat(path); err == nil {
+				return fmt.Errorf("%s already exists. Use --force to overwrite it", path)
+			}
+		}
+	}
+
+	if err := os.MkdirAll(devcontainerDirPath, 0755); err != nil {
+		return err
+	}
+	for path, contents := range files {
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -1,19 +1,33 @@
 package project
 
 import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
 	"fmt"
 	. "github.com/ar90n/code-code-server/devcontainer"
 	. "github.com/ar90n/code-code-server/dockerfile"
 	. "github.com/ar90n/code-code-server/settings"
 	"github.com/buildkite/interpolate"
+	"io"
+	"io/ioutil"
 	"math/rand"
 	"net"
+	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
 	"os/signal"
+	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
 	"strings"
-	"syscall"
+	"sync"
+	"time"
 )
 
 type ServiceURL struct {
@@ -22,169 +36,1617 @@ type ServiceURL struct {
 	WorkspaceFolder string
 }
 
+func (s *ServiceURL) hostPort() string {
+	// JoinHostPort brackets IPv6 literals
+	return net.JoinHostPort(s.Host, strconv.Itoa(s.Port))
+}
+
 func (s *ServiceURL) String() string {
-	return fmt.Sprintf("http://%s:%d/?folder=%s", s.Host, s.Port, s.WorkspaceFolder)
+	return fmt.Sprintf("http://%s/?folder=%s", s.hostPort(), s.WorkspaceFolder)
+}
+
+const (
+	Version       = "0.1.0"
+	InstanceLabel = "code-code-server=true"
+	NameLabel     = "code-code-server.name"
+	// OwnerLabel holds the container which sidecars and their network belong to
+	OwnerLabel = "code-code-server.owner"
+
+	codeServerPort  = 8080
+	maxReadyBackoff = 5 * time.Second
+)
+
+// execCommand and execCommandContext create the docker commands. Tests replace them to capture
+// the commands instead of running docker.
+var (
+	execCommand        = exec.Command
+	execCommandContext = exec.CommandContext
+)
+
+func (s *ServiceURL) healthzURL() string {
+	return fmt.Sprintf("http://%s/healthz", s.hostPort())
+}
+
+// WaitReady polls Code Server with exponential backoff until it answers HTTP requests or ctx is done.
+func (s *ServiceURL) WaitReady(ctx context.Context) error {
+	client := http.Client{Timeout: 5 * time.Second}
+	backoff := 100 * time.Millisecond
+	for {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, s.healthzURL(), nil)
+		if err != nil {
+			return err
+		}
+		if resp, err := client.Do(req); err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < http.StatusInternalServerError {
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("Code Server did not become ready: %w", ctx.Err())
+		case <-time.After(backoff):
+		}
+		if backoff *= 2; maxReadyBackoff < backoff {
+			backoff = maxReadyBackoff
+		}
+	}
+}
+
+type Options struct {
+	WrapOptions
+	MountConsistency string
+	UpdateRemoteUID  bool
+	StopTimeout      time.Duration
+	Network          string
+	Host             string
+	Interface        string
+	BindAddr         string
+	Quiet            bool
+	BuildOutput      io.Writer
+	BuildKit         bool
+	NoBuildKit       bool
+	Sidecars         []string
+	EnvFiles         []string
+	Persist          bool
+	BuildRetries     int
+	ExtraRunArgs     []string
+	Gpus             string
+	ContextDir       string
+	Platform         string
+	ImageTag         string
+	Name             string
+	Secrets          []string
+	WorkspaceFolder  string
+	SELinuxLabel     string
+	RemoveImage      bool
+	// BuildArgs are key=value pairs which override build.args of devcontainer.json
+	BuildArgs []string
+	// NoWorkspaceMount leaves the workspace folder out of the host. It is kept in a volume with CloneRepository
+	NoWorkspaceMount bool
+	// Keep leaves the container after it stops so that it can be inspected with docker logs and docker inspect
+	Keep bool
+	// NoDefaultIgnore sends .git and dependency directories in the build context without .dockerignore
+	NoDefaultIgnore bool
+	// Repository provides synced settings to Launch. No settings are synced if it is nil.
+	Repository Repository
+}
+
+// FindDevContainerJson returns the path of .devcontainer/devcontainer.json in the project directory
+// or .devcontainer.json at its root if the former does not exist.
+func FindDevContainerJson(projectDirPath string) (string, bool) {
+	candidates := []string{
+		filepath.Join(projectDirPath, ".devcontainer", "devcontainer.json"),
+		filepath.Join(projectDirPath, ".devcontainer.json"),
+	}
+	for _, v := range candidates {
+		if info, err := os.Stat(v); err == nil && !info.IsDir() {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+// ParseDevContainer parses the devcontainer.json at path and checks that the Dockerfile given by
+// build.dockerfile can be read.
+func ParseDevContainer(path string) (DevContainer, error) {
+	return ParseDevContainerInWorkspace(path, "")
+}
+
+// ParseDevContainerInWorkspace is ParseDevContainer for devcontainer.json given apart from the project
+// directory workspaceDir, such as by --config-file.
+func ParseDevContainerInWorkspace(path string, workspaceDir string) (DevContainer, error) {
+	devcontainer, err := ParseJsonInWorkspace(path, workspaceDir)
+	if err != nil {
+		return DevContainer{}, err
+	}
+	if err := validateDockerfile(devcontainer); err != nil {
+		return DevContainer{}, err
+	}
+	if err := validateWaitFor(devcontainer.GetWaitFor()); err != nil {
+		return DevContainer{}, err
+	}
+	if err := validateShutdownAction(devcontainer.GetShutdownAction()); err != nil {
+		return DevContainer{}, err
+	}
+	return devcontainer, nil
+}
+
+func validateWaitFor(waitFor string) error {
+	switch waitFor {
+	case "initializeCommand", "onCreateCommand", "updateContentCommand", "postCreateCommand", "postStartCommand":
+		return nil
+	}
+	return fmt.Errorf("waitFor must be one of initializeCommand, onCreateCommand, updateContentCommand, postCreateCommand and postStartCommand, got %s", waitFor)
+}
+
+func validateShutdownAction(shutdownAction string) error {
+	switch shutdownAction {
+	case "none", "stopContainer":
+		return nil
+	case "stopCompose":
+		return fmt.Errorf("shutdownAction stopCompose is not supported as Docker Compose is not supported")
+	}
+	return fmt.Errorf("shutdownAction must be none or stopContainer, got %s", shutdownAction)
+}
+
+func validateDockerfile(devcontainer DevContainer) error {
+	if devcontainer.Build.Dockerfile == "" {
+		return fmt.Errorf("devcontainer.json does not specify build.dockerfile")
+	}
+
+	dockerfilePath := devcontainer.DockerfilePath()
+	f, err := os.Open(dockerfilePath)
+	if err != nil {
+		return fmt.Errorf("Dockerfile %s given by build.dockerfile cannot be read: %w", dockerfilePath, err)
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		return fmt.Errorf("Dockerfile %s given by build.dockerfile is not a file", dockerfilePath)
+	}
+	return nil
+}
+
+type ContainerContext struct {
+	cmd         *exec.Cmd
+	name        string
+	started     bool
+	stopped     bool
+	stopTimeout time.Duration
+	exited      chan struct{}
+	waitErr     error
+	// shutdownAction is none to leave the container running on exit or stopContainer to stop it
+	shutdownAction string
+	// image is removed after the container stops if removeImage is set
+	image       string
+	removeImage bool
+	// keep is set if the container is not removed on exit
+	keep bool
+
+	sidecars      []sidecar
+	network       string
+	createNetwork bool
+}
+
+// Name returns the name of the container.
+func (c *ContainerContext) Name() string {
+	return c.name
+}
+
+// Start starts the container and returns once it is running.
+func (c *ContainerContext) Start() error {
+	if err := c.startSidecars(); err != nil {
+		return err
+	}
+	if err := c.cmd.Start(); err != nil {
+		c.stopSidecars()
+		return err
+	}
+	c.started = true
+
+	c.exited = make(chan struct{})
+	go func() {
+		c.waitErr = c.cmd.Wait()
+		close(c.exited)
+	}()
+
+	return c.waitForRunning()
+}
+
+func (c *ContainerContext) waitForRunning() error {
+	for {
+		select {
+		case <-c.exited:
+			if c.waitErr != nil {
+				return c.waitErr
+			}
+			return fmt.Errorf("Container %s exited", c.name)
+		case <-time.After(200 * time.Millisecond):
+		}
+
+		if isContainerRunning(c.name) {
+			return nil
+		}
+	}
+}
+
+func isContainerRunning(name string) bool {
+	out, err := execCommand(EngineBinary(), "inspect", "-f", "{{.State.Running}}", name).Output()
+	return err == nil && strings.TrimSpace(string(out)) == "true"
+}
+
+// Run starts the container and blocks until a signal is received, then stops the container.
+// If the container exits on its own first, Run reports its exit status.
+func (c *ContainerContext) Run() error {
+	// make sure the container does not outlive us on any exit path including panics
+	defer c.Stop()
+	if err := c.Start(); err != nil {
+		return err
+	}
+
+	if !c.waitForSignal() {
+		return c.exitedOnItsOwn()
+	}
+	if c.shutdownAction == "none" {
+		return c.detach()
+	}
+	if err := c.Stop(); err != nil {
+		// the container is already gone, so report why docker run exited
+		<-c.exited
+		if c.waitErr != nil {
+			return c.waitErr
+		}
+		return err
+	}
+
+	return nil
+}
+
+// detach exits docker run leaving the container and the sidecars running. docker run does not forward
+// signals to the container with shutdownAction none.
+func (c *ContainerContext) detach() error {
+	c.stopped = true
+	c.cmd.Process.Kill()
+	<-c.exited
+	fmt.Fprintf(os.Stderr, "Container %s keeps running. Stop it with `code stop %s`\n", c.name, c.name)
+	return nil
+}
+
+// Stop stops the container and waits for docker run to exit. It does nothing if the container
+// was never started or is already stopped.
+func (c *ContainerContext) Stop() error {
+	if !c.started || c.stopped {
+		return nil
+	}
+	c.stopped = true
+	defer c.stopSidecars()
+	if err := stopContainer(c.name, c.stopTimeout); err != nil {
+		return err
+	}
+
+	// docker run exits with non-zero status because we stopped the container
+	<-c.exited
+	c.printKept()
+	c.cleanupImage()
+	return nil
+}
+
+// printKept tells how to inspect and remove the container left by keep.
+func (c *ContainerContext) printKept() {
+	if c.keep {
+		fmt.Fprintf(os.Stderr, "Container %[1]s is kept. Inspect it with `%[2]s logs %[1]s` and remove it with `%[2]s rm %[1]s`\n", c.name, engine)
+	}
+}
+
+// cleanupImage removes the image of the container if it was asked to. Failures are only warned as the
+// container itself has already stopped.
+func (c *ContainerContext) cleanupImage() {
+	if !c.removeImage {
+		return
+	}
+	if err := RemoveImage(c.image); err != nil {
+		fmt.Fprintf(os.Stderr, "Failed to remove image %s: %s\n", c.image, err)
+	}
+}
+
+// RemoveImage removes the image unless a container, running or not, still uses it.
+func RemoveImage(tag string) error {
+	out, err := execCommand(EngineBinary(), "ps", "-a", "-q", "--filter", "ancestor="+tag).Output()
+	if err != nil {
+		return err
+	}
+	if users := strings.Fields(string(out)); len(users) != 0 {
+		fmt.Fprintf(os.Stderr, "Image %s is kept as it is used by %d other containers\n", tag, len(users))
+		return nil
+	}
+
+	cmd := execCommand(EngineBinary(), "rmi", tag)
+	cmd.Stdout = io.Discard
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// StopContainer stops a running container given by its name or the name of its project, as Stop does
+// for the container run by this process. Its sidecars are stopped and their network is removed too.
+func StopContainer(name string, timeout time.Duration) error {
+	containerName, err := resolveContainerName(name)
+	if err != nil {
+		return err
+	}
+	defer stopOwnedSidecars(containerName)
+	return stopContainer(containerName, timeout)
+}
+
+// stopContainer stops the named container gracefully and kills it if it does not stop in time.
+// A zero timeout uses the docker default grace period.
+func stopContainer(name string, timeout time.Duration) error {
+	args := []string{"stop"}
+	if 0 < timeout {
+		args = append(args, "-t", strconv.Itoa(int(timeout.Seconds())))
+	}
+	args = append(args, name)
+
+	// give docker stop some slack beyond the grace period before falling back to kill
+	ctx, cancel := context.WithTimeout(context.Background(), timeout+30*time.Second)
+	defer cancel()
+	cmd := execCommandContext(ctx, EngineBinary(), args...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err == nil {
+		return nil
+	}
+
+	return killContainer(name)
+}
+
+func killContainer(name string) error {
+	cmd := execCommand(EngineBinary(), "kill", name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ListContainers prints the running containers started by code-code-server.
+func ListContainers() error {
+	format := "table {{.Names}}\t{{.Image}}\t{{.Status}}\t{{.Ports}}"
+	cmd := execCommand(EngineBinary(), "ps", "--filter", "label="+InstanceLabel, "--format", format)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func listContainerNames(filter string) ([]string, error) {
+	out, err := execCommand(EngineBinary(), "ps", "--filter", "label="+InstanceLabel, "--filter", filter, "--format", "{{.Names}}").Output()
+	if err != nil {
+		return nil, err
+	}
+	return strings.Fields(string(out)), nil
+}
+
+// chooseContainer returns the container of the name, or the only one of the project of the name.
+func chooseContainer(name string, named []string, labeled []string) (string, error) {
+	for _, v := range named {
+		if v == name {
+			return name, nil
+		}
+	}
+	switch len(labeled) {
+	case 0:
+		return "", fmt.Errorf("No running container of code-code-server is named %s or belongs to the project %s", name, name)
+	case 1:
+		return labeled[0], nil
+	}
+	return "", fmt.Errorf("Project %s has several running containers (%s). Please provide a container name", name, strings.Join(labeled, ", "))
+}
+
+// resolveContainerName accepts either a container name or the name of a project in devcontainer.json.
+func resolveContainerName(name string) (string, error) {
+	named, err := listContainerNames("name=" + name)
+	if err != nil {
+		return "", err
+	}
+	labeled, err := listContainerNames(fmt.Sprintf("label=%s=%s", NameLabel, name))
+	if err != nil {
+		return "", err
+	}
+	return chooseContainer(name, named, labeled)
+}
+
+// ExecContainer runs the command in a running container. The working directory and the user default
+// to the workspace folder and the user the container runs as.
+func ExecContainer(name string, command []string, workdir string, user string) error {
+	containerName, err := resolveContainerName(name)
+	if err != nil {
+		return err
+	}
+
+	args := []string{"exec", "-i"}
+	if info, err := os.Stdin.Stat(); err == nil && info.Mode()&os.ModeCharDevice != 0 {
+		args = append(args, "-t")
+	}
+	if workdir != "" {
+		args = append(args, "-w", workdir)
+	}
+	if user != "" {
+		args = append(args, "-u", user)
+	}
+	args = append(args, containerName)
+	args = append(args, command...)
+
+	cmd := execCommand(EngineBinary(), args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+// ListExtensions prints the extensions installed in a running container with their versions. options must
+// have the extensions dir the image was built with.
+func ListExtensions(name string, options WrapOptions) error {
+	command := []string{"code-server", "--list-extensions", "--show-versions", "--extensions-dir", options.GetExtensionsDir()}
+	return ExecContainer(name, command, "", "")
+}
+
+// ShutdownSignals returns the signals that stop the container and cancel the build.
+func ShutdownSignals() []os.Signal {
+	return append([]os.Signal{}, shutdownSignals...)
+}
+
+// waitForSignal blocks until a signal is received or docker run exits. It returns false if
+// docker run exited first.
+func (c *ContainerContext) waitForSignal() bool {
+	s := make(chan os.Signal, 1)
+	signal.Notify(s, shutdownSignals...)
+	defer signal.Stop(s)
+
+	select {
+	case <-s:
+		return true
+	case <-c.exited:
+		return false
+	}
+}
+
+// exitedOnItsOwn cleans up after the container exited without being stopped and reports its
+// exit status.
+func (c *ContainerContext) exitedOnItsOwn() error {
+	c.stopped = true
+	c.stopSidecars()
+	c.printKept()
+	c.cleanupImage()
+
+	if c.waitErr != nil {
+		return fmt.Errorf("Container %s exited: %w", c.name, c.waitErr)
+	}
+	fmt.Fprintf(os.Stderr, "Container %s exited with status 0\n", c.name)
+	return nil
+}
+
+// FollowLogs streams the logs of the named container until it exits or a signal is received.
+// The container itself keeps running.
+func FollowLogs(name string) error {
+	cmd := execCommand(EngineBinary(), "logs", "-f", name)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	s := make(chan os.Signal, 1)
+	signal.Notify(s, shutdownSignals...)
+	defer signal.Stop(s)
+
+	select {
+	case err := <-done:
+		return err
+	case <-s:
+		cmd.Process.Kill()
+		<-done
+		return nil
+	}
+}
+
+// BuildError is returned when docker build fails. Output holds everything docker build printed.
+type BuildError struct {
+	Err    error
+	Output string
+}
+
+func (e *BuildError) Error() string {
+	return fmt.Sprintf("Failed to build image: %s", e.Err)
+}
+
+func (e *BuildError) Unwrap() error {
+	return e.Err
+}
+
+type lockedWriter struct {
+	mu *sync.Mutex
+	w  io.Writer
+}
+
+func (l *lockedWriter) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Write(p)
+}
+
+var (
+	// imageTagPattern follows the docker reference format without a digest
+	imageTagPattern      = regexp.MustCompile(`^[a-z0-9]+(([._]|__|-+)[a-z0-9]+)*(/[a-z0-9]+(([._]|__|-+)[a-z0-9]+)*)*(:[A-Za-z0-9_][A-Za-z0-9_.-]{0,127})?$`)
+	containerNamePattern = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]+$`)
+)
+
+// Validate checks the options which docker would reject only after the image is built.
+func (o *Options) Validate() error {
+	if o.ImageTag != "" && !imageTagPattern.MatchString(o.ImageTag) {
+		return fmt.Errorf("Image tag %s is invalid. It must consist of lowercase letters, digits and separators such as . _ - and /, optionally followed by :tag", o.ImageTag)
+	}
+	if o.Name != "" && !containerNamePattern.MatchString(o.Name) {
+		return fmt.Errorf("Container name %s is invalid. It must match [a-zA-Z0-9][a-zA-Z0-9_.-]+", o.Name)
+	}
+	switch o.SELinuxLabel {
+	case "", "z", "Z", "none":
+	default:
+		return fmt.Errorf("SELinux label must be z, Z or none, got %s", o.SELinuxLabel)
+	}
+	if len(o.Secrets) != 0 && o.NoBuildKit {
+		return fmt.Errorf("Build secrets require BuildKit and cannot be used without it")
+	}
+	if _, err := mergeBuildArgs(nil, o.BuildArgs); err != nil {
+		return err
+	}
+	if o.CloneRepository != "" && !o.NoWorkspaceMount {
+		return fmt.Errorf("A repository can be cloned only into the workspace which is not mounted from the host")
+	}
+	return nil
+}
+
+func getImageTag(devcontainer DevContainer, options Options) string {
+	if options.ImageTag != "" {
+		return options.ImageTag
+	}
+	return fmt.Sprintf("%s_code_coder_server", sanitizeImageName(devcontainer.Name))
+}
+
+var (
+	invalidImageNameChars = regexp.MustCompile(`[^a-z0-9._-]`)
+	imageNameSeparators   = regexp.MustCompile(`[._-]{2,}`)
+)
+
+// maxImageNameLength keeps the image tag well below the 255 characters limit of docker.
+const maxImageNameLength = 128
+
+// sanitizeImageName turns the name into a component of an image tag. It falls back to a hash of the
+// name when nothing is left.
+func sanitizeImageName(name string) string {
+	sanitized := invalidImageNameChars.ReplaceAllString(strings.ToLower(name), "_")
+	sanitized = imageNameSeparators.ReplaceAllString(sanitized, "_")
+	sanitized = strings.Trim(sanitized, "._-")
+	if maxImageNameLength < len(sanitized) {
+		sanitized = strings.TrimRight(sanitized[:maxImageNameLength], "._-")
+	}
+	if sanitized == "" {
+		hash := sha256.Sum256([]byte(name))
+		return fmt.Sprintf("%x", hash[:4])
+	}
+	return sanitized
+}
+
+func getLabelArgs(devcontainer DevContainer) []string {
+	return []string{
+		"--label", InstanceLabel,
+		"--label", fmt.Sprintf("%s=%s", NameLabel, devcontainer.Name),
+		"--label", fmt.Sprintf("code-code-server.version=%s", Version),
+	}
+}
+
+var (
+	directivePattern = regexp.MustCompile(`^#\s*(\w+)\s*=`)
+	runMountPattern  = regexp.MustCompile(`(?im)^\s*RUN\s+--mount=`)
+)
+
+// requiresBuildKit reports whether the Dockerfile uses a syntax directive or BuildKit only instructions.
+func requiresBuildKit(dockerfile string) bool {
+	for _, line := range strings.Split(dockerfile, "\n") {
+		// parser directives must precede any other comment or instruction
+		groups := directivePattern.FindStringSubmatch(strings.TrimSpace(line))
+		if groups == nil {
+			break
+		}
+		if strings.ToLower(groups[1]) == "syntax" {
+			return true
+		}
+	}
+	return runMountPattern.MatchString(dockerfile)
+}
+
+func getBuildKitEnv(dockerfile string, options Options) (string, bool) {
+	if options.NoBuildKit {
+		return "DOCKER_BUILDKIT=0", true
+	}
+	if options.BuildKit || len(options.Secrets) != 0 || requiresBuildKit(dockerfile) {
+		return "DOCKER_BUILDKIT=1", true
+	}
+	return "", false
+}
+
+// getBuildArgs returns --build-arg for build.args. The values are interpolated with the local variables
+// and ${localEnv:VAR} so that the build can be parameterized from the host.
+func getBuildArgs(devcontainer DevContainer) ([]string, error) {
+	keys := []string{}
+	for k := range devcontainer.Build.Args {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	variables := getLocalVariables(devcontainer)
+	args := []string{}
+	for _, k := range keys {
+		value, err := interpolateString(variables, devcontainer.Build.Args[k])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to interpolate build arg %s: %w", k, err)
+		}
+		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, value))
+	}
+	return args, nil
+}
+
+// mergeBuildArgs returns build.args overridden by the key=value pairs. args is not modified.
+func mergeBuildArgs(args map[string]string, overrides []string) (map[string]string, error) {
+	merged := map[string]string{}
+	for k, v := range args {
+		merged[k] = v
+	}
+	for _, v := range overrides {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Build arg %s must be key=value", v)
+		}
+		merged[kv[0]] = kv[1]
+	}
+	return merged, nil
+}
+
+// proxyVariables are the predefined build args of docker which need no ARG in the Dockerfile.
+var proxyVariables = []string{
+	"HTTP_PROXY", "http_proxy",
+	"HTTPS_PROXY", "https_proxy",
+	"FTP_PROXY", "ftp_proxy",
+	"NO_PROXY", "no_proxy",
+	"ALL_PROXY", "all_proxy",
+}
+
+// getProxyBuildArgs passes the proxy settings of the host to the build so that code-server and extensions
+// can be downloaded behind a proxy. build.args takes precedence.
+func getProxyBuildArgs(devcontainer DevContainer, getenv func(string) string) []string {
+	args := []string{}
+	for _, k := range proxyVariables {
+		if _, ok := devcontainer.Build.Args[k]; ok {
+			continue
+		}
+		if v := getenv(k); v != "" {
+			args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
+		}
+	}
+	return args
+}
+
+// getSecretArgs returns --secret of docker build for secrets such as id=npm,src=~/.npmrc
+// which Dockerfiles use with RUN --mount=type=secret,id=npm.
+func getSecretArgs(secrets []string) ([]string, error) {
+	args := []string{}
+	for _, secret := range secrets {
+		var id, src string
+		for _, field := range strings.Split(secret, ",") {
+			kv := strings.SplitN(field, "=", 2)
+			if len(kv) != 2 {
+				return nil, fmt.Errorf("Secret %s must be in the form of id=<id>,src=<path>", secret)
+			}
+			switch kv[0] {
+			case "id":
+				id = kv[1]
+			case "src", "source":
+				src = kv[1]
+			default:
+				return nil, fmt.Errorf("Secret %s has an unknown key %s", secret, kv[0])
+			}
+		}
+		if id == "" || src == "" {
+			return nil, fmt.Errorf("Secret %s must be in the form of id=<id>,src=<path>", secret)
+		}
+		if info, err := os.Stat(src); err != nil || info.IsDir() {
+			return nil, fmt.Errorf("Source %s of secret %s is not a file", src, id)
+		}
+		args = append(args, "--secret", fmt.Sprintf("id=%s,src=%s", id, src))
+	}
+	return args, nil
+}
+
+// getBuildContext returns the build context. A relative build.context is relative to devcontainer.json
+// as the devcontainer spec says, and the project directory is used when it is not given so that
+// the Dockerfile can COPY the project files. The context dir option overrides all of them.
+func getBuildContext(devcontainer DevContainer, options Options) string {
+	if options.ContextDir != "" {
+		return options.ContextDir
+	}
+	if devcontainer.Build.Context == "" {
+		return devcontainer.WorkspacePath()
+	}
+	if filepath.IsAbs(devcontainer.Build.Context) {
+		return devcontainer.Build.Context
+	}
+	return filepath.Join(devcontainer.DirPath, devcontainer.Build.Context)
+}
+
+func BuildImage(ctx context.Context, devcontainer DevContainer, repository Repository, options Options) (string, error) {
+	if options.CloneRepository != "" && options.CloneFolder == "" {
+		workspaceFolder, err := getWorkspaceFolder(devcontainer)
+		if err != nil {
+			return "", err
+		}
+		options.CloneFolder = workspaceFolder
+	}
+	if options.UpdateRemoteUID && options.CodeServerDirOwner == "" {
+		// the container runs as the host user instead of remoteUser
+		options.CodeServerDirOwner = getRunUser(devcontainer, options)
+	}
+	if options.Persist {
+		options.PersistedDirs = persistedUserDataDirs
+	}
+	dockerfileContent, files, err := WrapDockerFile(ctx, devcontainer, repository, options.WrapOptions)
+	if err != nil {
+		return "", err
+	}
+
+	tag := getImageTag(devcontainer, options)
+	buildContext := getBuildContext(devcontainer, options)
+	if info, err := os.Stat(buildContext); err != nil || !info.IsDir() {
+		return "", fmt.Errorf("Build context %s is not a directory", buildContext)
+	}
+
+	// the build context is sent as a tar stream holding the Dockerfile and the generated files
+	args := []string{"build", "-t", tag, "-f", path.Join(GeneratedDir, "Dockerfile")}
+	args = append(args, getLabelArgs(devcontainer)...)
+	if devcontainer.Build.Target != "" {
+		args = append(args, "--target", StageName)
+	}
+	devcontainer.Build.Args, err = mergeBuildArgs(devcontainer.Build.Args, options.BuildArgs)
+	if err != nil {
+		return "", err
+	}
+	buildArgs, err := getBuildArgs(devcontainer)
+	if err != nil {
+		return "", err
+	}
+	args = append(args, buildArgs...)
+	args = append(args, getProxyBuildArgs(devcontainer, os.Getenv)...)
+	secretArgs, err := getSecretArgs(options.Secrets)
+	if err != nil {
+		return "", err
+	}
+	args = append(args, secretArgs...)
+	if platform := getPlatform(devcontainer, options); platform != "" {
+		if err := validatePlatform(platform); err != nil {
+			return "", err
+		}
+		args = append(args, "--platform", platform)
+	}
+	args = append(args, "-")
+
+	defaultIgnore := defaultIgnorePatterns
+	if options.NoDefaultIgnore {
+		defaultIgnore = nil
+	}
+	for attempt := 0; ; attempt++ {
+		buildContextReader := newBuildContextReader(buildContext, defaultIgnore, dockerfileContent, files)
+		err := runBuild(ctx, args, buildContextReader, dockerfileContent, options)
+		buildContextReader.Close()
+		if err == nil {
+			break
+		}
+		if options.BuildRetries <= attempt || !isRetriableBuildError(err) {
+			return "", err
+		}
+
+		backoff := getBuildRetryBackoff(attempt)
+		fmt.Fprintf(os.Stderr, "Build failed with a transient error. Retrying in %s (%d/%d)\n", backoff, attempt+1, options.BuildRetries)
+		select {
+		case <-ctx.Done():
+			return "", ctx.Err()
+		case <-time.After(backoff):
+		}
+	}
+
+	return tag, nil
+}
+
+// getPlatform returns the target platform of the image. The option takes precedence over build.platform.
+func getPlatform(devcontainer DevContainer, options Options) string {
+	if options.Platform != "" {
+		return options.Platform
+	}
+	return devcontainer.Build.Platform
+}
+
+// normalizeArchitecture maps the architecture reported by docker info to the one used in platforms.
+func normalizeArchitecture(arch string) string {
+	switch arch {
+	case "x86_64":
+		return "amd64"
+	case "aarch64":
+		return "arm64"
+	case "armv7l":
+		return "arm"
+	}
+	return arch
+}
+
+// checkPlatform compares the platform such as linux/amd64 with the native one of the daemon.
+// It fails when the OS differs and reports whether the architecture must be emulated.
+func checkPlatform(platform string, nativeOS string, nativeArch string) (bool, error) {
+	parts := strings.Split(platform, "/")
+	if len(parts) < 2 || parts[0] == "" || parts[1] == "" {
+		return false, fmt.Errorf("Platform %s must be in the form of os/arch[/variant] such as linux/amd64", platform)
+	}
+	if parts[0] != nativeOS {
+		return false, fmt.Errorf("Platform %s is not supported by %s which runs %s containers", platform, DockerDaemon(), nativeOS)
+	}
+	return parts[1] != normalizeArchitecture(nativeArch), nil
+}
+
+func validatePlatform(platform string) error {
+	out, err := execCommand(EngineBinary(), "info", "-f", infoFormat("{{.OSType}} {{.Architecture}}", "{{.Host.OS}} {{.Host.Arch}}")).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to get the platform of %s: %w", DockerDaemon(), err)
+	}
+	fields := strings.Fields(string(out))
+	if len(fields) != 2 {
+		return fmt.Errorf("Failed to get the platform of %s: %s", DockerDaemon(), out)
+	}
+
+	emulated, err := checkPlatform(platform, fields[0], fields[1])
+	if err != nil {
+		return err
+	}
+	if emulated {
+		fmt.Fprintf(os.Stderr, "%s is emulated on %s/%s. Building and running the container may be much slower\n", platform, fields[0], normalizeArchitecture(fields[1]))
+	}
+	return nil
+}
+
+// runBuild runs docker build once and returns a BuildError holding its output on failure.
+func runBuild(ctx context.Context, args []string, buildContext io.Reader, dockerfileContent string, options Options) error {
+	// the docker client is killed when ctx is done, which also cancels the build on the daemon
+	cmd := execCommandContext(ctx, EngineBinary(), args...)
+	cmd.Stdin = buildContext
+	if env, ok := getBuildKitEnv(dockerfileContent, options); ok {
+		cmd.Env = append(os.Environ(), env)
+	}
+
+	var output bytes.Buffer
+	stdout := []io.Writer{&output}
+	stderr := []io.Writer{&output}
+	if !options.Quiet {
+		stdout = append(stdout, os.Stdout)
+		stderr = append(stderr, os.Stderr)
+	}
+	if options.BuildOutput != nil {
+		stdout = append(stdout, options.BuildOutput)
+		stderr = append(stderr, options.BuildOutput)
+	}
+	// stdout and stderr are copied concurrently into the same writers
+	var mu sync.Mutex
+	cmd.Stdout = &lockedWriter{mu: &mu, w: io.MultiWriter(stdout...)}
+	cmd.Stderr = &lockedWriter{mu: &mu, w: io.MultiWriter(stderr...)}
+	if err := cmd.Run(); err != nil {
+		if options.Quiet {
+			os.Stderr.Write(output.Bytes())
+		}
+		if ctx.Err() != nil {
+			err = ctx.Err()
+		}
+		return &BuildError{Err: err, Output: output.String()}
+	}
+	return nil
+}
+
+// retriableBuildErrors matches docker build output of failures which are likely to succeed on retry
+// such as network errors while pulling the base image or downloading code-server.
+var retriableBuildErrors = regexp.MustCompile(`(?i)(TLS handshake timeout|i/o timeout|connection reset by peer|connection refused|temporary failure in name resolution|no such host|unexpected EOF|toomanyrequests|50[234] (Bad Gateway|Service Unavailable|Gateway Time-?out)|curl: \((6|7|28|35|52|56)\))`)
+
+func isRetriableBuildError(err error) bool {
+	var buildErr *BuildError
+	if !errors.As(err, &buildErr) {
+		return false
+	}
+	// a cancelled or killed build is not transient
+	if errors.Is(buildErr.Err, context.Canceled) || errors.Is(buildErr.Err, context.DeadlineExceeded) {
+		return false
+	}
+	var exitErr *exec.ExitError
+	if errors.As(buildErr.Err, &exitErr) && exitErr.ExitCode() < 0 {
+		return false
+	}
+	return retriableBuildErrors.MatchString(buildErr.Output)
+}
+
+// getBuildRetryBackoff returns the wait before the next build attempt, doubling from 2 seconds up to 1 minute.
+func getBuildRetryBackoff(attempt int) time.Duration {
+	backoff := 2 * time.Second
+	for i := 0; i < attempt && backoff < time.Minute; i++ {
+		backoff *= 2
+	}
+	if time.Minute < backoff {
+		backoff = time.Minute
+	}
+	return backoff
+}
+
+func getAvailablePort() (int, error) {
+	listener, err := net.Listen("tcp", ":0")
+	if err != nil {
+		return 0, err
+	}
+	defer listener.Close()
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	return port, nil
+}
+
+func getHostname() (string, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return "", err
+	}
+	return hostname, nil
+}
+
+var virtualInterfacePrefixes = []string{
+	"docker", "podman", "br-", "veth", "virbr", "vmnet", "vboxnet", "cni", "flannel", "tun", "tap", "utun", "wg",
+}
+
+func isVirtualInterface(name string) bool {
+	for _, prefix := range virtualInterfacePrefixes {
+		if strings.HasPrefix(name, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// getAddressRank orders addresses by how likely a browser can reach them. Lower is better.
+func getAddressRank(ip net.IP) int {
+	rank := 0
+	if ip.To4() == nil {
+		rank += 2
+	}
+	if !ip.IsGlobalUnicast() {
+		rank += 1
+	}
+	return rank
+}
+
+func getIPAddress(interfaceName string) (string, error) {
+	interfaces, err := net.Interfaces()
+	if err != nil {
+		return "", err
+	}
+
+	var address net.IP
+	for _, iface := range interfaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		if interfaceName != "" && iface.Name != interfaceName {
+			continue
+		}
+		if interfaceName == "" && isVirtualInterface(iface.Name) {
+			continue
+		}
+
+		addrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, addr := range addrs {
+			ipnet, ok := addr.(*net.IPNet)
+			if !ok || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+				continue
+			}
+			if address == nil || getAddressRank(ipnet.IP) < getAddressRank(address) {
+				address = ipnet.IP
+			}
+		}
+	}
+
+	if address == nil {
+		if interfaceName != "" {
+			return "", fmt.Errorf("No IP address found on interface %s", interfaceName)
+		}
+		return "", fmt.Errorf("No IP address found, and no localhost found")
+	}
+	return address.String(), nil
+}
+
+func getBindAddr(options Options) string {
+	if options.BindAddr == "" {
+		return "0.0.0.0"
+	}
+	return options.BindAddr
+}
+
+func isLoopbackBindAddr(bindAddr string) bool {
+	if bindAddr == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(bindAddr)
+	return ip != nil && ip.IsLoopback()
+}
+
+// getRemoteDockerHost returns the host name of the docker daemon when DOCKER_HOST points at another machine.
+func getRemoteDockerHost(dockerHost string) (string, bool) {
+	u, err := url.Parse(dockerHost)
+	if err != nil || (u.Scheme != "tcp" && u.Scheme != "ssh" && u.Scheme != "http" && u.Scheme != "https") {
+		return "", false
+	}
+
+	host := u.Hostname()
+	if host == "" || host == "localhost" {
+		return "", false
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return "", false
+	}
+	return host, true
+}
+
+// DockerDaemon describes the docker daemon containers are run on.
+func DockerDaemon() string {
+	if dockerHost := os.Getenv("DOCKER_HOST"); dockerHost != "" {
+		return dockerHost
+	}
+	return "the local docker daemon"
+}
+
+func getHost(options Options) (string, error) {
+	if options.Host != "" {
+		return options.Host, nil
+	}
+	// the container runs on the daemon's machine, not on ours
+	if host, ok := getRemoteDockerHost(os.Getenv("DOCKER_HOST")); ok {
+		return host, nil
+	}
+	if isLoopbackBindAddr(getBindAddr(options)) {
+		return "localhost", nil
+	}
+
+	if options.Interface == "" {
+		if hostname, err := getHostname(); err == nil {
+			return hostname, nil
+		}
+	}
+	return getIPAddress(options.Interface)
+}
+
+// getNetwork returns the docker network given by the option or by runArgs.
+func getNetwork(devcontainer DevContainer, options Options) string {
+	if options.Network != "" {
+		return options.Network
+	}
+
+	network := ""
+	for i, v := range devcontainer.RunArgs {
+		if (v == "--network" || v == "--net") && i+1 < len(devcontainer.RunArgs) {
+			network = devcontainer.RunArgs[i+1]
+		} else if strings.HasPrefix(v, "--network=") || strings.HasPrefix(v, "--net=") {
+			network = strings.SplitN(v, "=", 2)[1]
+		}
+	}
+	return network
+}
+
+func isHostNetwork(devcontainer DevContainer, options Options) bool {
+	return getNetwork(devcontainer, options) == "host"
+}
+
+func validateNetwork(network string) error {
+	cmd := execCommand(EngineBinary(), "network", "inspect", network)
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("Docker network %s does not exist", network)
+	}
+	return nil
+}
+
+func GetServiceURL(devcontainer DevContainer, options Options) (ServiceURL, error) {
+	host, err := getHost(options)
+	if err != nil {
+		return ServiceURL{}, err
+	}
+
+	// on the host network Code Server listens on this port of the host instead of a published one
+	port, err := getAvailablePort()
+	if err != nil {
+		return ServiceURL{}, err
+	}
+
+	workspaceFolder, err := getOpenFolder(devcontainer, options)
+	if err != nil {
+		return ServiceURL{}, err
+	}
+
+	return ServiceURL{
+		Host:            host,
+		Port:            port,
+		WorkspaceFolder: workspaceFolder,
+	}, nil
+}
+
+// getOpenFolder returns the folder Code Server opens and commands run in. The workspace folder option
+// overrides workspaceFolder without changing where the workspace is mounted.
+func getOpenFolder(devcontainer DevContainer, options Options) (string, error) {
+	if options.WorkspaceFolder == "" {
+		return getWorkspaceFolder(devcontainer)
+	}
+
+	variables, err := getVariables(devcontainer)
+	if err != nil {
+		return "", err
+	}
+	workspaceFolder, err := interpolateString(variables, options.WorkspaceFolder)
+	if err != nil {
+		return "", err
+	}
+	if !path.IsAbs(workspaceFolder) {
+		return "", fmt.Errorf("Workspace folder %s must be an absolute path in the container", workspaceFolder)
+	}
+	return path.Clean(workspaceFolder), nil
 }
 
-type ContainerContext struct {
-	cmd  *exec.Cmd
-	name string
+var localEnvPattern = regexp.MustCompile(`\$\{localEnv:([^}:]+)(?::([^}]*))?\}`)
+
+// expandLocalEnv replaces ${localEnv:VAR} and ${localEnv:VAR:default} with the host environment.
+func expandLocalEnv(str string) string {
+	return localEnvPattern.ReplaceAllStringFunc(str, func(match string) string {
+		groups := localEnvPattern.FindStringSubmatch(match)
+		value := os.Getenv(groups[1])
+		if value == "" {
+			value = groups[2]
+		}
+		// escape the value so that the following interpolation leaves it as is
+		return strings.ReplaceAll(value, "$", "$$")
+	})
 }
 
-func (c *ContainerContext) Run() error {
-	if err := c.cmd.Start(); err != nil {
-		return err
+func interpolateString(env map[string]string, str string) (string, error) {
+	return interpolate.Interpolate(interpolate.NewMapEnv(env), expandLocalEnv(str))
+}
+
+func getLocalVariables(devcontainer DevContainer) map[string]string {
+	localWorkspaceFolder := devcontainer.WorkspacePath()
+	localWorkspaceFolderBasename := filepath.Base(localWorkspaceFolder)
+	return map[string]string{
+		"localWorkspaceFolder":         localWorkspaceFolder,
+		"localWorkspaceFolderBasename": localWorkspaceFolderBasename,
 	}
-	defer c.cmd.Wait()
+}
 
-	c.waitForSignal()
-	return c.stop()
+func getVariables(devcontainer DevContainer) (map[string]string, error) {
+	variables := getLocalVariables(devcontainer)
+	containerWorkspaceFolder, err := getWorkspaceFolder(devcontainer)
+	if err != nil {
+		return nil, err
+	}
+	variables["containerWorkspaceFolder"] = containerWorkspaceFolder
+	variables["containerWorkspaceFolderBasename"] = path.Base(containerWorkspaceFolder)
+	return variables, nil
 }
 
-func (c *ContainerContext) stop() error {
-	cmd := exec.Command("docker", "kill", c.name)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	return cmd.Run()
+// getContainerEnvArgs returns the args setting containerEnv and the host variables which remoteEnv refers to.
+// containerEnv is interpolated on the host, while remoteEnv which may refer to it is resolved in the container
+// by the entry script.
+func getContainerEnvArgs(devcontainer DevContainer, getenv func(string) string) ([]string, error) {
+	keys := []string{}
+	for k := range devcontainer.ContainerEnv {
+		if !EnvNamePattern.MatchString(k) {
+			return nil, fmt.Errorf("containerEnv %s is not a valid variable name", k)
+		}
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	variables, err := getVariables(devcontainer)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{}
+	for _, k := range keys {
+		value, err := interpolateString(variables, devcontainer.ContainerEnv[k])
+		if err != nil {
+			return nil, fmt.Errorf("Failed to interpolate containerEnv %s: %w", k, err)
+		}
+		args = append(args, "-e", fmt.Sprintf("%s=%s", k, value))
+	}
+	for _, v := range RemoteEnvLocalEnv(devcontainer.RemoteEnv, getenv) {
+		args = append(args, "-e", v)
+	}
+	return args, nil
 }
 
-func (c *ContainerContext) waitForSignal() {
-	s := make(chan os.Signal, 1)
-	signal.Notify(s, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-	<-s
+func getMountOption(mount string, key string) (string, bool) {
+	for _, field := range strings.Split(mount, ",") {
+		kv := strings.SplitN(field, "=", 2)
+		if strings.TrimSpace(kv[0]) != key {
+			continue
+		}
+		if len(kv) == 1 {
+			return "", true
+		}
+		return strings.TrimSpace(kv[1]), true
+	}
+	return "", false
 }
 
-func getImageTag(devcontainer DevContainer) string {
-	name := strings.ToLower(devcontainer.Name)
-	name = strings.ReplaceAll(name, " ", "_")
-	return fmt.Sprintf("%s_code_coder_server", name)
+func isBindMount(mount string) bool {
+	// docker treats a mount without an explicit type as a volume
+	mountType, _ := getMountOption(mount, "type")
+	return mountType == "bind"
 }
 
-func getBuildContext(devcontainer DevContainer) string {
-	if filepath.IsAbs(devcontainer.Build.Context) {
-		return devcontainer.Build.Context
-	} else {
-		return filepath.Join(devcontainer.DirPath, devcontainer.Build.Context)
+func validateMountConsistency(consistency string) error {
+	switch consistency {
+	case "", "consistent", "cached", "delegated":
+		return nil
 	}
+	return fmt.Errorf("Invalid mount consistency %s", consistency)
 }
 
-func BuildImage(devcontainer DevContainer, repository Repository) (string, error) {
-	dockerfileContent, err := WrapDockerFile(devcontainer, repository)
-	if err != nil {
+func getMountTarget(mount string) (string, bool) {
+	for _, key := range []string{"target", "destination", "dst"} {
+		if target, ok := getMountOption(mount, key); ok {
+			return target, true
+		}
+	}
+	return "", false
+}
+
+func getWorkspaceBinding(devcontainer DevContainer, options Options) (string, error) {
+	if err := validateMountConsistency(options.MountConsistency); err != nil {
 		return "", err
 	}
 
-	tag := getImageTag(devcontainer)
-	context := getBuildContext(devcontainer)
+	variables, err := getVariables(devcontainer)
+	if err != nil {
+		return "", err
+	}
 
-	args := []string{"build", "-t", tag, "-f", "-"}
-	for k, v := range devcontainer.Build.Args {
-		args = append(args, "--build-arg", fmt.Sprintf("%s=%s", k, v))
+	workspaceMount := devcontainer.WorkspaceMount
+	if workspaceMount == "" {
+		// the default mount target follows workspaceFolder so that the editor opens the mounted source
+		workspaceMount = "source=${localWorkspaceFolder},target=${containerWorkspaceFolder},type=bind"
 	}
-	args = append(args, context)
-	cmd := exec.Command("docker", args...)
-	cmd.Stdin = strings.NewReader(dockerfileContent)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	if err := cmd.Run(); err != nil {
+
+	workspaceBinding, err := interpolateString(variables, workspaceMount)
+	if err != nil {
 		return "", err
 	}
 
-	return tag, nil
+	if options.MountConsistency == "" || !isBindMount(workspaceBinding) {
+		return workspaceBinding, nil
+	}
+	if _, ok := getMountOption(workspaceBinding, "consistency"); ok {
+		return workspaceBinding, nil
+	}
+	return workspaceBinding + ",consistency=" + options.MountConsistency, nil
 }
 
-func getAvailablePort() (int, error) {
-	listener, err := net.Listen("tcp", ":0")
+func getMounts(devcontainer DevContainer) ([]string, error) {
+	variables, err := getVariables(devcontainer)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
-	defer listener.Close()
 
-	port := listener.Addr().(*net.TCPAddr).Port
-	return port, nil
+	mounts := []string{}
+	for _, v := range devcontainer.Mounts {
+		mount, err := interpolateString(variables, v)
+		if err != nil {
+			return nil, err
+		}
+		mounts = append(mounts, mount)
+	}
+	return mounts, nil
 }
 
-func getHostname() (string, error) {
-	hostname, err := os.Hostname()
-	if err != nil {
-		return "", err
+// isSELinuxEnforcing reports whether SELinux enforces its policy on this host.
+func isSELinuxEnforcing() bool {
+	enforce, err := ioutil.ReadFile("/sys/fs/selinux/enforce")
+	return err == nil && strings.TrimSpace(string(enforce)) == "1"
+}
+
+// getSELinuxLabel returns z or Z to relabel bind mounts, or an empty string not to. By default bind mounts
+// are relabeled as shared when SELinux is enforcing on this host and the daemon runs here too.
+func getSELinuxLabel(options Options, enforcing func() bool) string {
+	switch options.SELinuxLabel {
+	case "none":
+		return ""
+	case "":
+		if _, remote := getRemoteDockerHost(os.Getenv("DOCKER_HOST")); remote || !enforcing() {
+			return ""
+		}
+		return "z"
 	}
-	return hostname, nil
+	return options.SELinuxLabel
 }
 
-func getIPAddress() (string, error) {
-	addrs, err := net.InterfaceAddrs()
-	if err != nil {
-		return "", err
+// getMountArgs returns the args of docker run for the mount. Bind mounts are relabeled with the SELinux
+// label, which --mount of docker does not support, so they are given with -v then.
+func getMountArgs(mount string, selinuxLabel string) ([]string, error) {
+	if selinuxLabel == "" || !isBindMount(mount) {
+		return []string{"--mount", mount}, nil
+	}
+	if isPodman() {
+		relabel := map[string]string{"z": "shared", "Z": "private"}[selinuxLabel]
+		return []string{"--mount", mount + ",relabel=" + relabel}, nil
 	}
 
-	for _, address := range addrs {
-		if ipnet, ok := address.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
-			if ipnet.IP.To4() != nil {
-				return ipnet.IP.String(), nil
+	var source, target string
+	volumeOptions := []string{}
+	for _, field := range strings.Split(mount, ",") {
+		kv := strings.SplitN(strings.TrimSpace(field), "=", 2)
+		value := ""
+		if len(kv) == 2 {
+			value = kv[1]
+		}
+		switch kv[0] {
+		case "type":
+		case "source", "src":
+			source = value
+		case "target", "destination", "dst":
+			target = value
+		case "readonly", "ro":
+			if value == "" || value == "true" || value == "1" {
+				volumeOptions = append(volumeOptions, "ro")
 			}
+		case "consistency", "bind-propagation":
+			volumeOptions = append(volumeOptions, value)
+		default:
+			return nil, fmt.Errorf("Mount %s cannot be relabeled for SELinux because of %s. Use --selinux-label none and relabel it by yourself", mount, kv[0])
 		}
 	}
+	volumeOptions = append(volumeOptions, selinuxLabel)
+	return []string{"-v", fmt.Sprintf("%s:%s:%s", source, target, strings.Join(volumeOptions, ","))}, nil
+}
+
+var invalidVolumeNameChars = regexp.MustCompile(`[^a-zA-Z0-9_.-]`)
 
-	return "", fmt.Errorf("No IP address found, and no localhost found")
+// getWorkspaceVolume returns the volume of the project which holds the cloned repository.
+func getWorkspaceVolume(devcontainer DevContainer) string {
+	return getUserDataVolume(devcontainer) + "-workspace"
 }
 
-func GetServiceURL(devcontainer DevContainer) (ServiceURL, error) {
-	var host string
-	var err error
-	host, err = getHostname()
-	if err != nil {
-		host, err = getIPAddress()
+// persistedUserDataDirs are the directories of the user data dir which hold the state of Code Server. The
+// rest, such as settings.json, is left to the image so that rebuilds take effect.
+var persistedUserDataDirs = []string{"User/globalStorage", "User/workspaceStorage"}
+
+// getPersistMountArgs returns the args which mount a volume of the project on each of persistedUserDataDirs.
+func getPersistMountArgs(devcontainer DevContainer, options Options) []string {
+	args := []string{}
+	for _, dir := range persistedUserDataDirs {
+		volume := getUserDataVolume(devcontainer) + "-" + strings.ToLower(path.Base(dir))
+		target := path.Join(options.GetUserDataDir(), dir)
+		args = append(args, "--mount", fmt.Sprintf("source=%s,target=%s,type=volume", volume, target))
+	}
+	return args
+}
+
+// getUserDataVolume returns a volume name unique to the project so that projects do not share state.
+func getUserDataVolume(devcontainer DevContainer) string {
+	localWorkspaceFolder := devcontainer.WorkspacePath()
+	basename := invalidVolumeNameChars.ReplaceAllString(filepath.Base(localWorkspaceFolder), "_")
+	hash := sha256.Sum256([]byte(localWorkspaceFolder))
+	return fmt.Sprintf("code-code-server-%s-%x", basename, hash[:4])
+}
+
+func getWorkspaceFolder(devcontainer DevContainer) (string, error) {
+	// containerWorkspaceFolder is not available here because it is what we are resolving
+	variables := getLocalVariables(devcontainer)
+	if devcontainer.WorkspaceFolder == "" && devcontainer.WorkspaceMount != "" {
+		// open the mount target when only workspaceMount is given
+		workspaceBinding, err := interpolateString(variables, devcontainer.WorkspaceMount)
 		if err != nil {
-			return ServiceURL{}, err
+			return "", err
+		}
+		if target, ok := getMountTarget(workspaceBinding); ok {
+			return target, nil
 		}
 	}
 
-	port, err := getAvailablePort()
-	if err != nil {
-		return ServiceURL{}, err
+	workspaceFolder := devcontainer.WorkspaceFolder
+	if workspaceFolder == "" {
+		workspaceFolder = "/workspace/${localWorkspaceFolderBasename}"
 	}
 
-	workspaceFolder, err := getWorkspaceFolder(devcontainer)
-	if err != nil {
-		return ServiceURL{}, err
+	return interpolateString(variables, workspaceFolder)
+}
+
+type ForwardedPort struct {
+	Spec  string
+	Port  string
+	Label string
+	// HostPort is the port on the host, which is known after ResolveForwardedPorts. It is 0 if unknown.
+	HostPort int
+}
+
+// protocol returns the protocol of the forwarded port, which defaults to tcp.
+func (p *ForwardedPort) protocol() string {
+	if fields := strings.SplitN(p.Spec, "/", 2); len(fields) == 2 {
+		return fields[1]
 	}
+	return "tcp"
+}
 
-	return ServiceURL{
-		Host:            host,
-		Port:            port,
-		WorkspaceFolder: workspaceFolder,
-	}, nil
+// URL returns the URL of the forwarded port on the host, or an empty string if it is unknown or not tcp.
+func (p *ForwardedPort) URL(host string) string {
+	if p.HostPort == 0 || p.protocol() != "tcp" {
+		return ""
+	}
+	return fmt.Sprintf("http://%s", net.JoinHostPort(host, strconv.Itoa(p.HostPort)))
 }
 
-func getMapEnv(devcontainer DevContainer) interpolate.Env {
-	localWorkspaceFolder := filepath.Dir(devcontainer.DirPath)
-	localWorkspaceFolderBasename := filepath.Base(localWorkspaceFolder)
-	env := map[string]string{
-		"localWorkspaceFolder":         localWorkspaceFolder,
-		"localWorkspaceFolderBasename": localWorkspaceFolderBasename,
+// parsePublishedPort returns the host port from the output of docker port such as 0.0.0.0:49153.
+func parsePublishedPort(out string) (int, bool) {
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		i := strings.LastIndex(line, ":")
+		if i < 0 {
+			continue
+		}
+		if port, err := strconv.Atoi(strings.TrimSpace(line[i+1:])); err == nil {
+			return port, true
+		}
 	}
-	return interpolate.NewMapEnv(env)
+	return 0, false
 }
 
-func getWorkspaceBinding(devcontainer DevContainer) (string, error) {
-	workspaceMount := devcontainer.WorkspaceMount
-	if workspaceMount == "" {
-		workspaceMount = "source=${localWorkspaceFolder},target=/workspace/${localWorkspaceFolderBasename},type=bind"
+// getUnpublishedHostPort returns the host port of the spec such as 8000:3000 when docker does not know it.
+// The container port is on the host itself on the host network.
+func getUnpublishedHostPort(spec string) int {
+	fields := strings.Split(strings.SplitN(spec, "/", 2)[0], ":")
+	hostPort := fields[len(fields)-1]
+	if 1 < len(fields) && fields[len(fields)-2] != "" {
+		hostPort = fields[len(fields)-2]
+	}
+	port, _ := strconv.Atoi(hostPort)
+	return port
+}
+
+// ResolveForwardedPorts sets the host ports of the forwarded ports of the running container, as docker
+// publishes a port without a host port on a random one.
+func ResolveForwardedPorts(containerName string, ports []ForwardedPort) []ForwardedPort {
+	resolved := []ForwardedPort{}
+	for _, v := range ports {
+		out, err := execCommand(EngineBinary(), "port", containerName, fmt.Sprintf("%s/%s", v.Port, v.protocol())).Output()
+		if hostPort, ok := parsePublishedPort(string(out)); err == nil && ok {
+			v.HostPort = hostPort
+		} else {
+			v.HostPort = getUnpublishedHostPort(v.Spec)
+		}
+		resolved = append(resolved, v)
 	}
+	return resolved
+}
 
-	mapEnv := getMapEnv(devcontainer)
-	return interpolate.Interpolate(mapEnv, workspaceMount)
+// validateForwardPort checks a forwardPorts entry such as 3000, 8000:3000, 53/udp or 5353:53/udp. The
+// protocol must be one docker publishes.
+func validateForwardPort(spec string) error {
+	port := ForwardedPort{Spec: spec}
+	switch port.protocol() {
+	case "tcp", "udp", "sctp":
+	default:
+		return fmt.Errorf("Protocol of forwarded port %s must be tcp, udp or sctp, got %s", spec, port.protocol())
+	}
+	if _, err := strconv.Atoi(getContainerPort(spec)); err != nil {
+		return fmt.Errorf("Forwarded port %s does not end with a port number", spec)
+	}
+	return nil
 }
 
-func getWorkspaceFolder(devcontainer DevContainer) (string, error) {
-	workspaceFolder := devcontainer.WorkspaceFolder
-	if workspaceFolder == "" {
-		workspaceFolder = "/workspace/${localWorkspaceFolderBasename}"
+// getContainerPort returns the container port of a forwardPorts entry such as 3000, 8000:3000 or 3000/udp.
+func getContainerPort(spec string) string {
+	fields := strings.Split(spec, ":")
+	return strings.SplitN(fields[len(fields)-1], "/", 2)[0]
+}
+
+// GetForwardedPorts returns the forwardPorts entries except the ones portsAttributes asks to ignore.
+func GetForwardedPorts(devcontainer DevContainer) []ForwardedPort {
+	ports := []ForwardedPort{}
+	// appPort is the legacy form of forwardPorts
+	specs := append(append([]string{}, devcontainer.ForwardPorts...), devcontainer.AppPort...)
+	for _, v := range specs {
+		port := getContainerPort(v)
+		attribute := devcontainer.PortsAttributes[port]
+		if attribute.OnAutoForward == "ignore" {
+			continue
+		}
+		ports = append(ports, ForwardedPort{Spec: v, Port: port, Label: attribute.Label})
+	}
+	return ports
+}
+
+func getRunUser(devcontainer DevContainer, options Options) string {
+	if options.UpdateRemoteUID {
+		// uid and gid are -1 on platforms without them such as Windows
+		uid, gid := os.Getuid(), os.Getgid()
+		if 0 <= uid && 0 <= gid {
+			return fmt.Sprintf("%d:%d", uid, gid)
+		}
+	}
+	return devcontainer.RemoteUser
+}
+
+// getImageCommand returns ENTRYPOINT followed by CMD of the image.
+func getImageCommand(tag string) ([]string, error) {
+	out, err := execCommand(EngineBinary(), "image", "inspect", "-f", "{{json .Config.Entrypoint}}\n{{json .Config.Cmd}}", tag).Output()
+	if err != nil {
+		return nil, fmt.Errorf("Failed to inspect image %s: %w", tag, err)
+	}
+	return parseImageCommand(string(out))
+}
+
+func parseImageCommand(out string) ([]string, error) {
+	command := []string{}
+	for _, line := range strings.Split(strings.TrimSpace(out), "\n") {
+		var values []string
+		if err := json.Unmarshal([]byte(line), &values); err != nil {
+			return nil, fmt.Errorf("Failed to parse image command %s: %w", line, err)
+		}
+		command = append(command, values...)
+	}
+	return command, nil
+}
+
+// hasNvidiaRuntime reports whether the docker daemon has the NVIDIA container runtime.
+func hasNvidiaRuntime() bool {
+	if isPodman() {
+		// podman adds GPUs through CDI which is not reported by podman info
+		return true
+	}
+	out, err := execCommand(EngineBinary(), "info", "-f", "{{json .Runtimes}}").Output()
+	if err != nil {
+		return false
+	}
+	var runtimes map[string]interface{}
+	if err := json.Unmarshal(out, &runtimes); err != nil {
+		return false
+	}
+	_, ok := runtimes["nvidia"]
+	return ok
+}
+
+// getGpus returns the value of --gpus. The option takes precedence over hostRequirements.gpu,
+// and an optional GPU is used only when the NVIDIA runtime is available.
+func getGpus(devcontainer DevContainer, options Options, nvidiaAvailable func() bool) (string, error) {
+	gpu := devcontainer.HostRequirements.Gpu
+	gpus := options.Gpus
+	if gpus == "" && gpu.Required {
+		gpus = "all"
+	}
+	if gpus == "" && gpu.Optional && nvidiaAvailable() {
+		return "all", nil
+	}
+	if gpus == "" {
+		return "", nil
 	}
 
-	mapEnv := getMapEnv(devcontainer)
-	return interpolate.Interpolate(mapEnv, workspaceFolder)
+	if !nvidiaAvailable() {
+		return "", fmt.Errorf("GPU is requested but the NVIDIA container runtime is not available in %s. Install the NVIDIA Container Toolkit or remove hostRequirements.gpu and --gpus", DockerDaemon())
+	}
+	return gpus, nil
 }
 
 func makeRandomString() string {
@@ -196,38 +1658,319 @@ func makeRandomString() string {
 	return string(b)
 }
 
-func NewContainerContext(tag string, devcontainer DevContainer, serviceURL ServiceURL) (ContainerContext, error) {
-	name := makeRandomString()
-	portBinding := fmt.Sprintf("0.0.0.0:%d:8080", serviceURL.Port)
-	args := []string{"run", "--rm", "-p", portBinding, "--name", name}
+// hostProbes inspects the host and the docker daemon while building the args of docker run.
+type hostProbes struct {
+	validateNetwork  func(network string) error
+	nvidiaAvailable  func() bool
+	imageCommand     func(tag string) ([]string, error)
+	selinuxEnforcing func() bool
+	rootlessPodman   func() bool
+}
+
+var defaultHostProbes = hostProbes{
+	validateNetwork:  validateNetwork,
+	nvidiaAvailable:  hasNvidiaRuntime,
+	imageCommand:     getImageCommand,
+	selinuxEnforcing: isSELinuxEnforcing,
+	rootlessPodman:   isRootlessPodman,
+}
+
+// BuildRunArgs returns the args of docker run which starts the container. A random container name is
+// used unless options.Name is given. It runs docker to check the network, the NVIDIA runtime, the
+// command of the image and rootless podman, and reads the SELinux mode of this host.
+func BuildRunArgs(tag string, devcontainer DevContainer, serviceURL ServiceURL, options Options) ([]string, error) {
+	return buildRunArgs(tag, devcontainer, serviceURL, options, defaultHostProbes)
+}
+
+func buildRunArgs(tag string, devcontainer DevContainer, serviceURL ServiceURL, options Options, probes hostProbes) ([]string, error) {
+	name := options.Name
+	if name == "" {
+		name = makeRandomString()
+	}
+	args := []string{"run"}
+	if !options.Keep {
+		args = append(args, "--rm")
+	}
+	args = append(args, "--name", name)
+	args = append(args, getLabelArgs(devcontainer)...)
+	args = append(args, getEngineRunArgs(probes.rootlessPodman)...)
+	if devcontainer.GetShutdownAction() == "none" {
+		// Ctrl-C must not reach the container through docker run
+		args = append(args, "--sig-proxy=false")
+	}
+
+	hostNetwork := isHostNetwork(devcontainer, options)
+	hostPort := net.JoinHostPort(getBindAddr(options), strconv.Itoa(serviceURL.Port))
+	if hostNetwork {
+		// the container shares the host ports, so Code Server listens on the host port itself
+		args = append(args, "-e", fmt.Sprintf("%s=%s", BindAddrEnv, hostPort))
+	} else {
+		portBinding := fmt.Sprintf("%s:%d", hostPort, codeServerPort)
+		args = append(args, "-p", portBinding)
+	}
+	if options.Network != "" {
+		if err := probes.validateNetwork(options.Network); err != nil {
+			return nil, err
+		}
+		args = append(args, "--network", options.Network)
+	}
+
+	sidecars, err := getSidecars(options)
+	if err != nil {
+		return nil, err
+	}
+	if network, createNetwork := getSidecarNetwork(devcontainer, options, name, sidecars); createNetwork {
+		args = append(args, "--network", network)
+	}
+	if len(sidecars) != 0 && hostNetwork {
+		return nil, fmt.Errorf("Sidecars are not supported on the host network")
+	}
+
+	selinuxLabel := getSELinuxLabel(options, probes.selinuxEnforcing)
+	workdir := serviceURL.WorkspaceFolder
+	if !options.NoWorkspaceMount {
+		workspaceBinding, err := getWorkspaceBinding(devcontainer, options)
+		if err != nil {
+			return nil, err
+		}
+		workspaceMountArgs, err := getMountArgs(workspaceBinding, selinuxLabel)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, workspaceMountArgs...)
+	} else if options.CloneRepository != "" {
+		// the clone outlives the container as VS Code clones a repository in a volume
+		workspaceFolder, err := getWorkspaceFolder(devcontainer)
+		if err != nil {
+			return nil, err
+		}
+		workspaceMount := fmt.Sprintf("source=%s,target=%s,type=volume", getWorkspaceVolume(devcontainer), workspaceFolder)
+		args = append(args, "--mount", workspaceMount)
+		// docker would create the open folder inside, which makes the workspace folder look already cloned
+		workdir = workspaceFolder
+	}
 
-	workspaceBinding, err := getWorkspaceBinding(devcontainer)
+	mounts, err := getMounts(devcontainer)
 	if err != nil {
-		return ContainerContext{}, err
+		return nil, err
+	}
+	for _, v := range mounts {
+		mountArgs, err := getMountArgs(v, selinuxLabel)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, mountArgs...)
 	}
-	args = append(args, "--mount", workspaceBinding)
+	if options.Persist {
+		args = append(args, getPersistMountArgs(devcontainer, options)...)
+	}
+
+	args = append(args, "-w", workdir)
 
-	args = append(args, "-w", serviceURL.WorkspaceFolder)
+	// docker gives variables set by -e precedence over the ones from env files
+	for _, v := range options.EnvFiles {
+		if _, err := os.Stat(v); err != nil {
+			return nil, fmt.Errorf("Env file %s does not exist", v)
+		}
+		args = append(args, "--env-file", v)
+	}
+	containerEnvArgs, err := getContainerEnvArgs(devcontainer, os.Getenv)
+	if err != nil {
+		return nil, err
+	}
+	args = append(args, containerEnvArgs...)
 
 	for _, v := range devcontainer.RunArgs {
 		args = append(args, v)
 	}
-	for _, v := range devcontainer.ForwardPorts {
-		args = append(args, "-p", v)
+	if platform := getPlatform(devcontainer, options); platform != "" {
+		args = append(args, "--platform", platform)
+	}
+	gpus, err := getGpus(devcontainer, options, probes.nvidiaAvailable)
+	if err != nil {
+		return nil, err
+	}
+	if gpus != "" {
+		args = append(args, "--gpus", gpus)
+	}
+	// extra args come after runArgs so that they take precedence for flags which may only be given once
+	args = append(args, options.ExtraRunArgs...)
+	if !hostNetwork {
+		for _, v := range GetForwardedPorts(devcontainer) {
+			if err := validateForwardPort(v.Spec); err != nil {
+				return nil, err
+			}
+			args = append(args, "-p", v.Spec)
+		}
+	}
+	if user := getRunUser(devcontainer, options); user != "" {
+		args = append(args, "-u", user)
+	}
+	if devcontainer.ShouldOverrideCommand() {
+		args = append(args, tag)
+	} else {
+		// the entry script starts code-server and then runs the command of the image
+		command, err := probes.imageCommand(tag)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, "--entrypoint", EntryScript, tag)
+		args = append(args, command...)
+	}
+
+	return args, nil
+}
+
+var memorySizePattern = regexp.MustCompile(`^(\d+(?:\.\d+)?)\s*(tb|gb|mb|kb|b)?$`)
+
+// parseMemorySize parses a size of hostRequirements such as 4gb into bytes.
+func parseMemorySize(size string) (int64, error) {
+	groups := memorySizePattern.FindStringSubmatch(strings.ToLower(strings.TrimSpace(size)))
+	if groups == nil {
+		return 0, fmt.Errorf("Size %s must be a number followed by tb, gb, mb or kb", size)
+	}
+	value, err := strconv.ParseFloat(groups[1], 64)
+	if err != nil {
+		return 0, err
+	}
+	units := map[string]float64{"": 1, "b": 1, "kb": 1 << 10, "mb": 1 << 20, "gb": 1 << 30, "tb": 1 << 40}
+	return int64(value * units[groups[2]]), nil
+}
+
+// memoryTolerance is the fraction of hostRequirements.memory which the host may lack, as the total memory
+// reported by docker excludes the memory reserved by the kernel and is below the nominal RAM.
+const memoryTolerance = 0.1
+
+// checkHostRequirements fails when the host has fewer CPUs or clearly less memory than hostRequirements.
+// They are minimums of the host, so the container is not limited to them.
+func checkHostRequirements(requirements HostRequirements, ncpu int, memTotal int64) error {
+	if ncpu < requirements.Cpus {
+		return fmt.Errorf("hostRequirements.cpus requires %d CPUs but %s has only %d", requirements.Cpus, DockerDaemon(), ncpu)
+	}
+	if requirements.Memory != "" {
+		memory, err := parseMemorySize(requirements.Memory)
+		if err != nil {
+			return err
+		}
+		if float64(memTotal) < float64(memory)*(1-memoryTolerance) {
+			return fmt.Errorf("hostRequirements.memory requires %s but %s has only %.1fgb", requirements.Memory, DockerDaemon(), float64(memTotal)/(1<<30))
+		}
+		if memTotal < memory {
+			fmt.Fprintf(os.Stderr, "hostRequirements.memory requires %s but %s has %.1fgb. Going on as it is slightly short\n", requirements.Memory, DockerDaemon(), float64(memTotal)/(1<<30))
+		}
+	}
+	return nil
+}
+
+func validateHostRequirements(requirements HostRequirements) error {
+	if requirements.Cpus == 0 && requirements.Memory == "" {
+		return nil
+	}
+	out, err := execCommand(EngineBinary(), "info", "-f", infoFormat("{{.NCPU}} {{.MemTotal}}", "{{.Host.CPUs}} {{.Host.MemTotal}}")).Output()
+	if err != nil {
+		return fmt.Errorf("Failed to get the resources of %s: %w", DockerDaemon(), err)
+	}
+	var ncpu int
+	var memTotal int64
+	if _, err := fmt.Sscanf(string(out), "%d %d", &ncpu, &memTotal); err != nil {
+		return fmt.Errorf("Failed to get the resources of %s: %s", DockerDaemon(), out)
+	}
+	return checkHostRequirements(requirements, ncpu, memTotal)
+}
+
+func getSidecars(options Options) ([]sidecar, error) {
+	sidecars := []sidecar{}
+	for _, v := range options.Sidecars {
+		s, err := parseSidecar(v)
+		if err != nil {
+			return nil, err
+		}
+		sidecars = append(sidecars, s)
+	}
+	return sidecars, nil
+}
+
+// getSidecarNetwork returns the network which sidecars join. It is the network of the container,
+// or a dedicated one named after the container which must be created on start.
+func getSidecarNetwork(devcontainer DevContainer, options Options, name string, sidecars []sidecar) (string, bool) {
+	network := getNetwork(devcontainer, options)
+	if len(sidecars) != 0 && network == "" {
+		return name, true
+	}
+	return network, false
+}
+
+func NewContainerContext(tag string, devcontainer DevContainer, serviceURL ServiceURL, options Options) (ContainerContext, error) {
+	if options.Name == "" {
+		options.Name = makeRandomString()
+	}
+	args, err := BuildRunArgs(tag, devcontainer, serviceURL, options)
+	if err != nil {
+		return ContainerContext{}, err
+	}
+	if err := validateHostRequirements(devcontainer.HostRequirements); err != nil {
+		return ContainerContext{}, err
 	}
-	if devcontainer.RemoteUser != "" {
-		args = append(args, "-u", devcontainer.RemoteUser)
+	sidecars, err := getSidecars(options)
+	if err != nil {
+		return ContainerContext{}, err
 	}
-	args = append(args, tag)
-	args = append(args)
+	network, createNetwork := getSidecarNetwork(devcontainer, options, options.Name, sidecars)
 
-	cmd := exec.Command("docker", args...)
+	cmd := execCommand(EngineBinary(), args...)
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
 	ctx := ContainerContext{
-		cmd:  cmd,
-		name: name,
+		cmd:            cmd,
+		name:           options.Name,
+		stopTimeout:    options.StopTimeout,
+		shutdownAction: devcontainer.GetShutdownAction(),
+		image:          tag,
+		removeImage:    options.RemoveImage,
+		keep:           options.Keep,
+		sidecars:       sidecars,
+		network:        network,
+		createNetwork:  createNetwork,
 	}
 	return ctx, nil
 }
+
+type emptyRepository struct{}
+
+func (r emptyRepository) Get(ctx context.Context, filename string) (string, error) {
+	return "", fmt.Errorf("%s not found", filename)
+}
+
+// Launch builds the image, starts the container and waits until it is running. It returns the
+// URL of Code Server and a function which stops the container.
+func Launch(ctx context.Context, devcontainer DevContainer, options Options) (ServiceURL, func() error, error) {
+	if err := options.Validate(); err != nil {
+		return ServiceURL{}, nil, err
+	}
+	repository := options.Repository
+	if repository == nil {
+		repository = emptyRepository{}
+	}
+
+	tag, err := BuildImage(ctx, devcontainer, repository, options)
+	if err != nil {
+		return ServiceURL{}, nil, err
+	}
+
+	serviceURL, err := GetServiceURL(devcontainer, options)
+	if err != nil {
+		return ServiceURL{}, nil, err
+	}
+
+	containerContext, err := NewContainerContext(tag, devcontainer, serviceURL, options)
+	if err != nil {
+		return ServiceURL{}, nil, err
+	}
+	if err := containerContext.Start(); err != nil {
+		containerContext.Stop()
+		return ServiceURL{}, nil, err
+	}
+
+	return serviceURL, containerContext.Stop, nil
+}
@@ -0,0 +1,1606 @@
+package project
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	. "github.com/ar90n/code-code-server/devcontainer"
+	. "github.com/ar90n/code-code-server/dockerfile"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWorkspaceBindingAndFolder(t *testing.T) {
+	cases := []struct {
+		workspaceMount  string
+		workspaceFolder string
+		expectedBinding string
+		expectedWorkdir string
+	}{
+		{
+			"",
+			"",
+			"source=/home/user/project,target=/workspace/project,type=bind",
+			"/workspace/project",
+		},
+		{
+			"source=${localWorkspaceFolder},target=/src,type=bind",
+			"/src/app",
+			"source=/home/user/project,target=/src,type=bind",
+			"/src/app",
+		},
+		{
+			"",
+			"/home/vscode/${localWorkspaceFolderBasename}",
+			"source=/home/user/project,target=/home/vscode/project,type=bind",
+			"/home/vscode/project",
+		},
+		{
+			"source=project-volume,target=/data/project,type=volume",
+			"",
+			"source=project-volume,target=/data/project,type=volume",
+			"/data/project",
+		},
+	}
+
+	for _, c := range cases {
+		devcontainer := DevContainer{}
+		devcontainer.DirPath = "/home/user/project/.devcontainer"
+		devcontainer.WorkspaceMount = c.workspaceMount
+		devcontainer.WorkspaceFolder = c.workspaceFolder
+
+		binding, err := getWorkspaceBinding(devcontainer, Options{})
+		if err != nil {
+			t.Errorf("Error getting workspace binding: %s", err)
+		}
+		if binding != c.expectedBinding {
+			t.Errorf("Expected workspace binding to be %s, got %s", c.expectedBinding, binding)
+		}
+
+		workdir, err := getWorkspaceFolder(devcontainer)
+		if err != nil {
+			t.Errorf("Error getting workspace folder: %s", err)
+		}
+		if workdir != c.expectedWorkdir {
+			t.Errorf("Expected workspace folder to be %s, got %s", c.expectedWorkdir, workdir)
+		}
+	}
+}
+
+func TestWorkspaceBindingConsistency(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.DirPath = "/home/user/project/.devcontainer"
+
+	binding, err := getWorkspaceBinding(devcontainer, Options{MountConsistency: "cached"})
+	if err != nil {
+		t.Errorf("Error getting workspace binding: %s", err)
+	}
+	expected := "source=/home/user/project,target=/workspace/project,type=bind,consistency=cached"
+	if binding != expected {
+		t.Errorf("Expected workspace binding to be %s, got %s", expected, binding)
+	}
+
+	devcontainer.WorkspaceMount = "source=project-volume,target=/workspace/project,type=volume"
+	binding, err = getWorkspaceBinding(devcontainer, Options{MountConsistency: "cached"})
+	if err != nil {
+		t.Errorf("Error getting workspace binding: %s", err)
+	}
+	if binding != devcontainer.WorkspaceMount {
+		t.Errorf("Expected workspace binding to be %s, got %s", devcontainer.WorkspaceMount, binding)
+	}
+}
+
+func TestMountConsistency(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.DirPath = "/home/user/project/.devcontainer"
+	cases := []struct {
+		workspaceMount string
+		consistency    string
+		expected       string
+		valid          bool
+	}{
+		{"", "", "source=/home/user/project,target=/workspace/project,type=bind", true},
+		{"", "delegated", "source=/home/user/project,target=/workspace/project,type=bind,consistency=delegated", true},
+		{"source=/src,target=/workspace/src,type=bind,consistency=consistent", "cached", "source=/src,target=/workspace/src,type=bind,consistency=consistent", true},
+		{"source=/src,target=/workspace/src", "cached", "source=/src,target=/workspace/src", true},
+		{"", "fast", "", false},
+	}
+	for _, c := range cases {
+		devcontainer.WorkspaceMount = c.workspaceMount
+		binding, err := getWorkspaceBinding(devcontainer, Options{MountConsistency: c.consistency})
+		if (err == nil) != c.valid {
+			t.Errorf("Expected mount consistency %s to be valid: %v, got %v", c.consistency, c.valid, err)
+			continue
+		}
+		if binding != c.expected {
+			t.Errorf("Expected workspace binding to be %s, got %s", c.expected, binding)
+		}
+	}
+}
+
+func TestInterpolateVariables(t *testing.T) {
+	t.Setenv("CODE_CODE_SERVER_TEST", "value$")
+
+	devcontainer := DevContainer{}
+	devcontainer.DirPath = "/home/user/project/.devcontainer"
+	devcontainer.WorkspaceFolder = "/src/${localWorkspaceFolderBasename}"
+	variables, err := getVariables(devcontainer)
+	if err != nil {
+		t.Errorf("Error getting variables: %s", err)
+	}
+
+	cases := []struct {
+		value    string
+		expected string
+	}{
+		{"${containerWorkspaceFolder}", "/src/project"},
+		{"${containerWorkspaceFolderBasename}", "project"},
+		{"${localEnv:CODE_CODE_SERVER_TEST}", "value$"},
+		{"${localEnv:CODE_CODE_SERVER_UNSET}", ""},
+		{"${localEnv:CODE_CODE_SERVER_UNSET:default}", "default"},
+		{"${localWorkspaceFolder}/${localEnv:CODE_CODE_SERVER_TEST}", "/home/user/project/value$"},
+	}
+	for _, c := range cases {
+		value, err := interpolateString(variables, c.value)
+		if err != nil {
+			t.Errorf("Error interpolating %s: %s", c.value, err)
+		}
+		if value != c.expected {
+			t.Errorf("Expected %s to be interpolated to %s, got %s", c.value, c.expected, value)
+		}
+	}
+}
+
+func TestBuildArgs(t *testing.T) {
+	t.Setenv("CODE_CODE_SERVER_TEST", "token")
+
+	devcontainer := DevContainer{}
+	devcontainer.DirPath = "/home/user/project/.devcontainer"
+	devcontainer.Build.Args = map[string]string{
+		"TOKEN":   "${localEnv:CODE_CODE_SERVER_TEST}",
+		"PROJECT": "${localWorkspaceFolderBasename}",
+		"VERSION": "1.0",
+	}
+	args, err := getBuildArgs(devcontainer)
+	if err != nil {
+		t.Fatalf("Error getting build args: %s", err)
+	}
+	expected := []string{"--build-arg", "PROJECT=project", "--build-arg", "TOKEN=token", "--build-arg", "VERSION=1.0"}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected build args to be %v, got %v", expected, args)
+	}
+}
+
+func TestMergeBuildArgs(t *testing.T) {
+	args := map[string]string{"VERSION": "1.0", "VARIANT": "bullseye"}
+	merged, err := mergeBuildArgs(args, []string{"VERSION=1.1", "EXTRA=a=b", "EMPTY="})
+	if err != nil {
+		t.Fatalf("Error merging build args: %s", err)
+	}
+	expected := map[string]string{"VERSION": "1.1", "VARIANT": "bullseye", "EXTRA": "a=b", "EMPTY": ""}
+	if !reflect.DeepEqual(merged, expected) {
+		t.Errorf("Expected build args to be %v, got %v", expected, merged)
+	}
+	if args["VERSION"] != "1.0" {
+		t.Errorf("Expected build.args not to be modified, got %v", args)
+	}
+
+	for _, v := range []string{"VERSION", "=1.0"} {
+		if _, err := mergeBuildArgs(args, []string{v}); err == nil {
+			t.Errorf("Expected an error for build arg %s", v)
+		}
+	}
+}
+
+func TestContainerEnvArgs(t *testing.T) {
+	t.Setenv("CODE_CODE_SERVER_TEST", "token")
+
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer"}
+	devcontainer.ContainerEnv = map[string]string{
+		"TOKEN":     "${localEnv:CODE_CODE_SERVER_TEST}",
+		"WORKSPACE": "${containerWorkspaceFolder}",
+	}
+	devcontainer.RemoteEnv = map[string]string{"HOST_TOKEN": "${localEnv:CODE_CODE_SERVER_TEST}"}
+	args, err := getContainerEnvArgs(devcontainer, os.Getenv)
+	if err != nil {
+		t.Fatalf("Error getting containerEnv args: %s", err)
+	}
+	expected := []string{
+		"-e", "TOKEN=token",
+		"-e", "WORKSPACE=/workspace/project",
+		"-e", "CODE_CODE_SERVER_LOCAL_ENV_CODE_CODE_SERVER_TEST=token",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected containerEnv args to be %v, got %v", expected, args)
+	}
+
+	devcontainer.ContainerEnv = map[string]string{"A=B": "c"}
+	if _, err := getContainerEnvArgs(devcontainer, os.Getenv); err == nil {
+		t.Errorf("Expected an error for an invalid variable name")
+	}
+}
+
+func TestOpenFolder(t *testing.T) {
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer"}
+	cases := []struct {
+		workspaceFolder string
+		expected        string
+		fails           bool
+	}{
+		{"", "/workspace/project", false},
+		{"/workspace/project/cmd/", "/workspace/project/cmd", false},
+		{"${containerWorkspaceFolder}/docs", "/workspace/project/docs", false},
+		{"project/cmd", "", true},
+	}
+	for _, c := range cases {
+		folder, err := getOpenFolder(devcontainer, Options{WorkspaceFolder: c.workspaceFolder})
+		if (err != nil) != c.fails {
+			t.Errorf("Expected error for %s to be %v, got %v", c.workspaceFolder, c.fails, err)
+		}
+		if folder != c.expected {
+			t.Errorf("Expected folder of %s to be %s, got %s", c.workspaceFolder, c.expected, folder)
+		}
+	}
+
+	// the workspace is still mounted to workspaceFolder
+	binding, err := getWorkspaceBinding(devcontainer, Options{WorkspaceFolder: "/workspace/project/cmd"})
+	if err != nil {
+		t.Fatalf("Error getting workspace binding: %s", err)
+	}
+	if expected := "source=/home/user/project,target=/workspace/project,type=bind"; binding != expected {
+		t.Errorf("Expected workspace binding to be %s, got %s", expected, binding)
+	}
+}
+
+func TestProxyBuildArgs(t *testing.T) {
+	env := map[string]string{
+		"HTTPS_PROXY": "http://proxy.example.com:3128",
+		"NO_PROXY":    "localhost,.example.com",
+		"http_proxy":  "http://proxy.example.com:3128",
+	}
+	devcontainer := DevContainer{}
+	devcontainer.Build.Args = map[string]string{"http_proxy": "http://other.example.com:8080"}
+
+	args := getProxyBuildArgs(devcontainer, func(k string) string { return env[k] })
+	expected := []string{
+		"--build-arg", "HTTPS_PROXY=http://proxy.example.com:3128",
+		"--build-arg", "NO_PROXY=localhost,.example.com",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected proxy build args to be %v, got %v", expected, args)
+	}
+}
+
+func TestServiceURL(t *testing.T) {
+	cases := []struct {
+		host     string
+		expected string
+	}{
+		{"localhost", "http://localhost:8080/?folder=/workspace/project"},
+		{"192.168.0.1", "http://192.168.0.1:8080/?folder=/workspace/project"},
+		{"fe80::1", "http://[fe80::1]:8080/?folder=/workspace/project"},
+	}
+
+	for _, c := range cases {
+		url := ServiceURL{Host: c.host, Port: 8080, WorkspaceFolder: "/workspace/project"}
+		if url.String() != c.expected {
+			t.Errorf("Expected URL to be %s, got %s", c.expected, url.String())
+		}
+	}
+}
+
+func TestRequiresBuildKit(t *testing.T) {
+	cases := []struct {
+		dockerfile string
+		expected   bool
+	}{
+		{"FROM golang:1.17", false},
+		{"# syntax=docker/dockerfile:1\nFROM golang:1.17", true},
+		{"# escape=`\n# syntax = docker/dockerfile:1\nFROM golang:1.17", true},
+		{"# comment\n# syntax=docker/dockerfile:1\nFROM golang:1.17", false},
+		{"FROM golang:1.17\n# syntax=docker/dockerfile:1", false},
+		{"FROM golang:1.17\nRUN --mount=type=cache,target=/root/.cache go build", true},
+	}
+
+	for _, c := range cases {
+		if requiresBuildKit(c.dockerfile) != c.expected {
+			t.Errorf("Expected requiresBuildKit to be %v for %q", c.expected, c.dockerfile)
+		}
+	}
+}
+
+func TestMounts(t *testing.T) {
+	t.Setenv("CODE_CODE_SERVER_TEST_HOME", "/home/user")
+
+	devcontainer := DevContainer{}
+	devcontainer.DirPath = "/home/user/project/.devcontainer"
+	devcontainer.Mounts = []string{
+		"source=${localEnv:CODE_CODE_SERVER_TEST_HOME}/.ssh,target=/home/vscode/.ssh,type=bind,readonly",
+		"source=${localWorkspaceFolderBasename}-cache,target=${containerWorkspaceFolder}/.cache,type=volume",
+	}
+
+	mounts, err := getMounts(devcontainer)
+	if err != nil {
+		t.Errorf("Error getting mounts: %s", err)
+	}
+	expected := []string{
+		"source=/home/user/.ssh,target=/home/vscode/.ssh,type=bind,readonly",
+		"source=project-cache,target=/workspace/project/.cache,type=volume",
+	}
+	if len(mounts) != len(expected) {
+		t.Fatalf("Expected %d mounts, got %d", len(expected), len(mounts))
+	}
+	for i := range expected {
+		if mounts[i] != expected[i] {
+			t.Errorf("Expected mount to be %s, got %s", expected[i], mounts[i])
+		}
+	}
+}
+
+func newTestServiceURL(t *testing.T, server *httptest.Server) ServiceURL {
+	host, port, err := net.SplitHostPort(server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Error parsing server address: %s", err)
+	}
+	portNumber, _ := strconv.Atoi(port)
+	return ServiceURL{Host: host, Port: portNumber, WorkspaceFolder: "/workspace/project"}
+}
+
+func TestWaitReady(t *testing.T) {
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&requests, 1) < 3 {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer server.Close()
+
+	url := newTestServiceURL(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := url.WaitReady(ctx); err != nil {
+		t.Errorf("Expected Code Server to become ready, got %s", err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected 3 requests, got %d", n)
+	}
+}
+
+func TestWaitReadyTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	url := newTestServiceURL(t, server)
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	if err := url.WaitReady(ctx); err == nil {
+		t.Errorf("Expected WaitReady to time out")
+	}
+}
+
+func TestParseSidecar(t *testing.T) {
+	cases := []struct {
+		value string
+		alias string
+		image string
+	}{
+		{"postgres", "postgres", "postgres"},
+		{"postgres:14", "postgres", "postgres:14"},
+		{"bitnami/redis:7.0", "redis", "bitnami/redis:7.0"},
+		{"localhost:5000/team/api:latest", "api", "localhost:5000/team/api:latest"},
+		{"db=postgres:14", "db", "postgres:14"},
+	}
+
+	for _, c := range cases {
+		s, err := parseSidecar(c.value)
+		if err != nil {
+			t.Errorf("Error parsing sidecar %s: %s", c.value, err)
+		}
+		if s.alias != c.alias || s.image != c.image {
+			t.Errorf("Expected sidecar %s to be (%s, %s), got (%s, %s)", c.value, c.alias, c.image, s.alias, s.image)
+		}
+	}
+
+	if _, err := parseSidecar("=postgres"); err == nil {
+		t.Errorf("Expected an error for a sidecar without alias")
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	cases := []struct {
+		runArgs       []string
+		options       Options
+		network       string
+		sidecarNet    string
+		createNetwork bool
+	}{
+		{nil, Options{}, "", "", false},
+		{nil, Options{Sidecars: []string{"postgres"}}, "", "dev", true},
+		{[]string{"--network", "backend"}, Options{Sidecars: []string{"postgres"}}, "backend", "backend", false},
+		{[]string{"--net=backend"}, Options{}, "backend", "backend", false},
+		{[]string{"--network=backend"}, Options{Network: "frontend"}, "frontend", "frontend", false},
+		{[]string{"--network=host"}, Options{Sidecars: []string{"postgres"}}, "host", "host", false},
+	}
+	for _, c := range cases {
+		devcontainer := DevContainer{RunArgs: c.runArgs}
+		if network := getNetwork(devcontainer, c.options); network != c.network {
+			t.Errorf("Expected network of %v with %+v to be %q, got %q", c.runArgs, c.options, c.network, network)
+		}
+
+		sidecars, err := getSidecars(c.options)
+		if err != nil {
+			t.Fatalf("Error getting sidecars: %s", err)
+		}
+		network, createNetwork := getSidecarNetwork(devcontainer, c.options, "dev", sidecars)
+		if network != c.sidecarNet || createNetwork != c.createNetwork {
+			t.Errorf("Expected sidecar network of %v with %+v to be (%q, %v), got (%q, %v)", c.runArgs, c.options, c.sidecarNet, c.createNetwork, network, createNetwork)
+		}
+	}
+
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project", RunArgs: []string{"--network=host"}}
+	serviceURL := ServiceURL{Host: "localhost", Port: 8080, WorkspaceFolder: "/workspace/project"}
+	options := Options{Name: "dev", Sidecars: []string{"postgres"}, SELinuxLabel: "none"}
+	if _, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, options); err == nil {
+		t.Errorf("Expected an error for sidecars on the host network")
+	}
+}
+
+func TestRemoteDockerHost(t *testing.T) {
+	cases := []struct {
+		dockerHost string
+		host       string
+		remote     bool
+	}{
+		{"", "", false},
+		{"unix:///var/run/docker.sock", "", false},
+		{"npipe:////./pipe/docker_engine", "", false},
+		{"tcp://127.0.0.1:2375", "", false},
+		{"tcp://localhost:2375", "", false},
+		{"tcp://192.168.0.10:2376", "192.168.0.10", true},
+		{"ssh://user@build-server", "build-server", true},
+		{"ssh://user@[fd00::1]:22", "fd00::1", true},
+	}
+
+	for _, c := range cases {
+		host, remote := getRemoteDockerHost(c.dockerHost)
+		if host != c.host || remote != c.remote {
+			t.Errorf("Expected DOCKER_HOST %s to be (%s, %v), got (%s, %v)", c.dockerHost, c.host, c.remote, host, remote)
+		}
+	}
+}
+
+func TestInitProject(t *testing.T) {
+	projectDirPath, _ := ioutil.TempDir("", "project")
+	defer os.RemoveAll(projectDirPath)
+
+	options := InitOptions{Image: "golang:1.17", Extensions: []string{"golang.Go"}}
+	if err := InitProject(projectDirPath, options); err != nil {
+		t.Fatalf("Error initializing project: %s", err)
+	}
+
+	devcontainer, err := ParseJson(filepath.Join(projectDirPath, ".devcontainer", "devcontainer.json"))
+	if err != nil {
+		t.Fatalf("Error parsing devcontainer.json: %s", err)
+	}
+	if devcontainer.Name != filepath.Base(projectDirPath) {
+		t.Errorf("Expected name to be %s, got %s", filepath.Base(projectDirPath), devcontainer.Name)
+	}
+	if devcontainer.Extensions[0] != "golang.Go" {
+		t.Errorf("Expected extensions[0] to be golang.Go, got %s", devcontainer.Extensions[0])
+	}
+	dockerfile, _ := ioutil.ReadFile(filepath.Join(projectDirPath, ".devcontainer", "Dockerfile"))
+	if string(dockerfile) != "FROM golang:1.17\n" {
+		t.Errorf("Expected Dockerfile to be FROM golang:1.17, got %s", dockerfile)
+	}
+
+	if err := InitProject(projectDirPath, options); err == nil {
+		t.Errorf("Expected an error when files already exist")
+	}
+	options.Force = true
+	if err := InitProject(projectDirPath, options); err != nil {
+		t.Errorf("Expected files to be overwritten, got %s", err)
+	}
+}
+
+func TestParseDevContainer(t *testing.T) {
+	projectDirPath, _ := ioutil.TempDir("", "project")
+	defer os.RemoveAll(projectDirPath)
+	if err := InitProject(projectDirPath, InitOptions{}); err != nil {
+		t.Fatalf("Error initializing project: %s", err)
+	}
+
+	devcontainerJsonPath := filepath.Join(projectDirPath, ".devcontainer", "devcontainer.json")
+	devcontainer, err := ParseDevContainer(devcontainerJsonPath)
+	if err != nil {
+		t.Fatalf("Error parsing devcontainer.json: %s", err)
+	}
+	if devcontainer.DirPath != filepath.Join(projectDirPath, ".devcontainer") {
+		t.Errorf("Expected DirPath to be %s, got %s", filepath.Join(projectDirPath, ".devcontainer"), devcontainer.DirPath)
+	}
+
+	os.Remove(filepath.Join(projectDirPath, ".devcontainer", "Dockerfile"))
+	if _, err := ParseDevContainer(devcontainerJsonPath); err == nil {
+		t.Errorf("Expected an error when the Dockerfile does not exist")
+	}
+}
+
+func TestForwardedPorts(t *testing.T) {
+	devcontainer := DevContainer{}
+	devcontainer.ForwardPorts = []string{"3000", "8000:8000", "127.0.0.1:9229:9229", "5353/udp"}
+	devcontainer.AppPort = AppPort{"4000"}
+	devcontainer.PortsAttributes = map[string]PortAttribute{
+		"3000": {Label: "Web", OnAutoForward: "openBrowser"},
+		"9229": {Label: "Debugger", OnAutoForward: "ignore"},
+	}
+
+	expected := []ForwardedPort{
+		{Spec: "3000", Port: "3000", Label: "Web"},
+		{Spec: "8000:8000", Port: "8000", Label: ""},
+		{Spec: "5353/udp", Port: "5353", Label: ""},
+		{Spec: "4000", Port: "4000", Label: ""},
+	}
+	ports := GetForwardedPorts(devcontainer)
+	if len(ports) != len(expected) {
+		t.Fatalf("Expected %d forwarded ports, got %d", len(expected), len(ports))
+	}
+	for i := range expected {
+		if ports[i] != expected[i] {
+			t.Errorf("Expected forwarded port to be %v, got %v", expected[i], ports[i])
+		}
+	}
+}
+
+func TestForwardPortProtocols(t *testing.T) {
+	cases := []struct {
+		spec     string
+		protocol string
+		port     string
+		valid    bool
+	}{
+		{"3000", "tcp", "3000", true},
+		{"3000/tcp", "tcp", "3000", true},
+		{"53/udp", "udp", "53", true},
+		{"5353:53/udp", "udp", "53", true},
+		{"127.0.0.1:5353:53/udp", "udp", "53", true},
+		{"9899/sctp", "sctp", "9899", true},
+		{"53/UDP", "UDP", "53", false},
+		{"53/icmp", "icmp", "53", false},
+		{"web", "tcp", "web", false},
+	}
+	for _, c := range cases {
+		port := ForwardedPort{Spec: c.spec, Port: getContainerPort(c.spec)}
+		if port.protocol() != c.protocol || port.Port != c.port {
+			t.Errorf("Expected %s to forward %s/%s, got %s/%s", c.spec, c.port, c.protocol, port.Port, port.protocol())
+		}
+		if err := validateForwardPort(c.spec); (err == nil) != c.valid {
+			t.Errorf("Expected %s to be valid %v, got %v", c.spec, c.valid, err)
+		}
+	}
+
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project"}
+	devcontainer.ForwardPorts = []string{"3000", "5353:53/udp"}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+	args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, Options{Name: "dev", SELinuxLabel: "none"})
+	if err != nil {
+		t.Fatalf("Error building run args: %s", err)
+	}
+	if joined := strings.Join(args, " "); !strings.Contains(joined, "-p 3000 -p 5353:53/udp") {
+		t.Errorf("Expected the forwarded ports to be published with their protocols, got %s", joined)
+	}
+
+	devcontainer.ForwardPorts = []string{"53/icmp"}
+	if _, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, Options{Name: "dev", SELinuxLabel: "none"}); err == nil {
+		t.Errorf("Expected an error for the forwarded port with an unsupported protocol")
+	}
+}
+
+func TestParseImageCommand(t *testing.T) {
+	cases := []struct {
+		out      string
+		expected []string
+	}{
+		{"null\nnull\n", []string{}},
+		{"null\n[\"nginx\",\"-g\",\"daemon off;\"]\n", []string{"nginx", "-g", "daemon off;"}},
+		{"[\"/docker-entrypoint.sh\"]\n[\"postgres\"]\n", []string{"/docker-entrypoint.sh", "postgres"}},
+	}
+
+	for _, c := range cases {
+		command, err := parseImageCommand(c.out)
+		if err != nil {
+			t.Errorf("Error parsing %s: %s", c.out, err)
+		}
+		if !reflect.DeepEqual(command, c.expected) {
+			t.Errorf("Expected command to be %v, got %v", c.expected, command)
+		}
+	}
+}
+
+func TestIsRetriableBuildError(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected bool
+	}{
+		{&BuildError{Err: errors.New("exit status 1"), Output: "Get https://registry-1.docker.io/v2/: net/http: TLS handshake timeout"}, true},
+		{&BuildError{Err: errors.New("exit status 1"), Output: "curl: (6) Could not resolve host: code-server.dev"}, true},
+		{&BuildError{Err: errors.New("exit status 1"), Output: "toomanyrequests: You have reached your pull rate limit"}, true},
+		{&BuildError{Err: errors.New("exit status 1"), Output: "dockerfile parse error line 3: unknown instruction: RUNN"}, false},
+		{&BuildError{Err: context.Canceled, Output: "i/o timeout"}, false},
+		{errors.New("i/o timeout"), false},
+	}
+
+	for _, c := range cases {
+		if retriable := isRetriableBuildError(c.err); retriable != c.expected {
+			t.Errorf("Expected %v to be retriable %v, got %v", c.err, c.expected, retriable)
+		}
+	}
+}
+
+func TestBuildRetryBackoff(t *testing.T) {
+	expected := []time.Duration{2 * time.Second, 4 * time.Second, 8 * time.Second, 16 * time.Second, 32 * time.Second, time.Minute, time.Minute}
+	for attempt, v := range expected {
+		if backoff := getBuildRetryBackoff(attempt); backoff != v {
+			t.Errorf("Expected backoff of attempt %d to be %s, got %s", attempt, v, backoff)
+		}
+	}
+}
+
+func TestFindDevContainerJson(t *testing.T) {
+	projectDirPath, _ := ioutil.TempDir("", "project")
+	defer os.RemoveAll(projectDirPath)
+
+	if _, ok := FindDevContainerJson(projectDirPath); ok {
+		t.Errorf("Expected devcontainer.json not to be found")
+	}
+
+	rootJsonPath := filepath.Join(projectDirPath, ".devcontainer.json")
+	ioutil.WriteFile(rootJsonPath, []byte(`{"build": {"dockerfile": "Dockerfile"}}`), 0644)
+	ioutil.WriteFile(filepath.Join(projectDirPath, "Dockerfile"), []byte("FROM golang:1.17\n"), 0644)
+	if path, _ := FindDevContainerJson(projectDirPath); path != rootJsonPath {
+		t.Errorf("Expected devcontainer.json to be %s, got %s", rootJsonPath, path)
+	}
+	devcontainer, err := ParseDevContainer(rootJsonPath)
+	if err != nil {
+		t.Fatalf("Error parsing .devcontainer.json: %s", err)
+	}
+	if devcontainer.WorkspacePath() != projectDirPath {
+		t.Errorf("Expected workspace path to be %s, got %s", projectDirPath, devcontainer.WorkspacePath())
+	}
+	if variables := getLocalVariables(devcontainer); variables["localWorkspaceFolder"] != projectDirPath {
+		t.Errorf("Expected localWorkspaceFolder to be %s, got %s", projectDirPath, variables["localWorkspaceFolder"])
+	}
+
+	// .devcontainer/devcontainer.json takes precedence
+	if err := InitProject(projectDirPath, InitOptions{}); err != nil {
+		t.Fatalf("Error initializing project: %s", err)
+	}
+	dirJsonPath := filepath.Join(projectDirPath, ".devcontainer", "devcontainer.json")
+	if path, _ := FindDevContainerJson(projectDirPath); path != dirJsonPath {
+		t.Errorf("Expected devcontainer.json to be %s, got %s", dirJsonPath, path)
+	}
+}
+
+func TestBuildContext(t *testing.T) {
+	cases := []struct {
+		dirPath  string
+		context  string
+		expected string
+	}{
+		{"/home/user/project/.devcontainer", "", "/home/user/project"},
+		{"/home/user/project/.devcontainer", ".", "/home/user/project/.devcontainer"},
+		{"/home/user/project/.devcontainer", "..", "/home/user/project"},
+		{"/home/user/project/.devcontainer", "/srv/context", "/srv/context"},
+		{"/home/user/project", "", "/home/user/project"},
+		{"/home/user/project", ".", "/home/user/project"},
+	}
+
+	for _, c := range cases {
+		devcontainer := DevContainer{DirPath: c.dirPath}
+		devcontainer.Build.Context = c.context
+		if buildContext := getBuildContext(devcontainer, Options{}); buildContext != c.expected {
+			t.Errorf("Expected build context of %s in %s to be %s, got %s", c.context, c.dirPath, c.expected, buildContext)
+		}
+	}
+
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer"}
+	devcontainer.Build.Context = ".."
+	if buildContext := getBuildContext(devcontainer, Options{ContextDir: "/home/user/project/services/api"}); buildContext != "/home/user/project/services/api" {
+		t.Errorf("Expected build context to be overridden by the option, got %s", buildContext)
+	}
+}
+
+func TestGpus(t *testing.T) {
+	cases := []struct {
+		gpu             GpuRequirement
+		option          string
+		nvidiaAvailable bool
+		expected        string
+		fails           bool
+	}{
+		{GpuRequirement{}, "", false, "", false},
+		{GpuRequirement{Required: true}, "", true, "all", false},
+		{GpuRequirement{Required: true}, "", false, "", true},
+		{GpuRequirement{Optional: true}, "", true, "all", false},
+		{GpuRequirement{Optional: true}, "", false, "", false},
+		{GpuRequirement{Required: true}, "device=0", true, "device=0", false},
+		{GpuRequirement{}, "all", false, "", true},
+	}
+
+	for _, c := range cases {
+		devcontainer := DevContainer{}
+		devcontainer.HostRequirements.Gpu = c.gpu
+		gpus, err := getGpus(devcontainer, Options{Gpus: c.option}, func() bool { return c.nvidiaAvailable })
+		if (err != nil) != c.fails {
+			t.Errorf("Expected error of %+v with %s to be %v, got %v", c.gpu, c.option, c.fails, err)
+		}
+		if gpus != c.expected {
+			t.Errorf("Expected gpus of %+v with %s to be %s, got %s", c.gpu, c.option, c.expected, gpus)
+		}
+	}
+}
+
+func TestDockerignore(t *testing.T) {
+	ignore := parseDockerignore([]string{
+		"# comment",
+		"node_modules",
+		"**/*.log",
+		"/build/",
+		"*.md",
+		"!README.md",
+		"te?t",
+		"[ab].txt",
+	})
+
+	cases := []struct {
+		path     string
+		expected bool
+	}{
+		{"node_modules", true},
+		{"node_modules/lodash/index.js", true},
+		{"src/node_modules", false},
+		{"app.log", true},
+		{"logs/2022/app.log", true},
+		{"build/main", true},
+		{"CHANGELOG.md", true},
+		{"README.md", false},
+		{"docs/guide.md", false},
+		{"test", true},
+		{"a.txt", true},
+		{"c.txt", false},
+		{"main.go", false},
+	}
+
+	for _, c := range cases {
+		if ignored := ignore.ignores(c.path); ignored != c.expected {
+			t.Errorf("Expected %s to be ignored %v, got %v", c.path, c.expected, ignored)
+		}
+	}
+}
+
+// readTarEntries returns the contents of the files in the tar stream by their names.
+func readTarEntries(t *testing.T, r io.Reader) map[string]string {
+	entries := map[string]string{}
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("Error reading build context: %s", err)
+		}
+		contents, _ := ioutil.ReadAll(tr)
+		entries[header.Name] = string(contents)
+	}
+	return entries
+}
+
+func TestWriteBuildContext(t *testing.T) {
+	contextDirPath, _ := ioutil.TempDir("", "context")
+	defer os.RemoveAll(contextDirPath)
+	os.MkdirAll(filepath.Join(contextDirPath, "src"), 0755)
+	os.MkdirAll(filepath.Join(contextDirPath, "node_modules", "lodash"), 0755)
+	ioutil.WriteFile(filepath.Join(contextDirPath, "src", "main.go"), []byte("package main\n"), 0644)
+	ioutil.WriteFile(filepath.Join(contextDirPath, "node_modules", "lodash", "index.js"), []byte("\n"), 0644)
+	ioutil.WriteFile(filepath.Join(contextDirPath, ".dockerignore"), []byte("node_modules\n.*\n"), 0644)
+
+	var buf bytes.Buffer
+	files := GeneratedFiles{"settings.json": {Contents: "{}\n"}}
+	if err := writeBuildContext(&buf, contextDirPath, nil, "FROM golang:1.17", files); err != nil {
+		t.Fatalf("Error writing build context: %s", err)
+	}
+
+	entries := readTarEntries(t, &buf)
+	expected := map[string]string{
+		"src/":                            "",
+		"src/main.go":                     "package main\n",
+		".code-code-server/Dockerfile":    "FROM golang:1.17",
+		".code-code-server/settings.json": "{}\n",
+		".dockerignore":                   "",
+	}
+	if !reflect.DeepEqual(entries, expected) {
+		t.Errorf("Expected build context to be %v, got %v", expected, entries)
+	}
+}
+
+func TestWriteBuildContextHostFile(t *testing.T) {
+	contextDirPath := t.TempDir()
+	packagePath := filepath.Join(t.TempDir(), "code-server_4.1.0_amd64.deb")
+	if err := ioutil.WriteFile(packagePath, []byte("deb"), 0644); err != nil {
+		t.Fatalf("Error writing package: %s", err)
+	}
+
+	var buf bytes.Buffer
+	files := GeneratedFiles{"code-server_4.1.0_amd64.deb": {HostPath: packagePath}}
+	if err := writeBuildContext(&buf, contextDirPath, nil, "FROM golang:1.17", files); err != nil {
+		t.Fatalf("Error writing build context: %s", err)
+	}
+
+	entries := readTarEntries(t, &buf)
+	if contents := entries[".code-code-server/code-server_4.1.0_amd64.deb"]; contents != "deb" {
+		t.Errorf("Expected the package to be copied into the build context, got %v", entries)
+	}
+
+	files["code-server_4.1.0_amd64.deb"] = GeneratedFile{HostPath: filepath.Join(contextDirPath, "missing.deb")}
+	if err := writeBuildContext(&bytes.Buffer{}, contextDirPath, nil, "FROM golang:1.17", files); err == nil {
+		t.Errorf("Expected an error for a missing host file")
+	}
+}
+
+func TestWriteBuildContextDefaultIgnore(t *testing.T) {
+	contextDirPath := t.TempDir()
+	os.MkdirAll(filepath.Join(contextDirPath, ".git"), 0755)
+	os.MkdirAll(filepath.Join(contextDirPath, "web", "node_modules"), 0755)
+	ioutil.WriteFile(filepath.Join(contextDirPath, ".git", "HEAD"), []byte("ref: refs/heads/main\n"), 0644)
+	ioutil.WriteFile(filepath.Join(contextDirPath, "web", "node_modules", "index.js"), []byte("\n"), 0644)
+	ioutil.WriteFile(filepath.Join(contextDirPath, "web", "package.json"), []byte("{}\n"), 0644)
+
+	cases := []struct {
+		defaultIgnore []string
+		expected      []string
+	}{
+		{defaultIgnorePatterns, []string{"web/", "web/package.json"}},
+		{nil, []string{".git/", ".git/HEAD", "web/", "web/node_modules/", "web/node_modules/index.js", "web/package.json"}},
+	}
+	for _, c := range cases {
+		var buf bytes.Buffer
+		if err := writeBuildContext(&buf, contextDirPath, c.defaultIgnore, "FROM golang:1.17", GeneratedFiles{}); err != nil {
+			t.Fatalf("Error writing build context: %s", err)
+		}
+		names := []string{}
+		for name := range readTarEntries(t, &buf) {
+			if !strings.HasPrefix(name, GeneratedDir) && name != ".dockerignore" {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		if !reflect.DeepEqual(names, c.expected) {
+			t.Errorf("Expected build context to hold %v, got %v", c.expected, names)
+		}
+	}
+}
+
+func TestCheckPlatform(t *testing.T) {
+	cases := []struct {
+		platform string
+		os       string
+		arch     string
+		emulated bool
+		fails    bool
+	}{
+		{"linux/amd64", "linux", "x86_64", false, false},
+		{"linux/amd64", "linux", "aarch64", true, false},
+		{"linux/arm64/v8", "linux", "aarch64", false, false},
+		{"windows/amd64", "linux", "x86_64", false, true},
+		{"amd64", "linux", "x86_64", false, true},
+	}
+
+	for _, c := range cases {
+		emulated, err := checkPlatform(c.platform, c.os, c.arch)
+		if (err != nil) != c.fails {
+			t.Errorf("Expected error of %s on %s/%s to be %v, got %v", c.platform, c.os, c.arch, c.fails, err)
+		}
+		if emulated != c.emulated {
+			t.Errorf("Expected %s on %s/%s to be emulated %v, got %v", c.platform, c.os, c.arch, c.emulated, emulated)
+		}
+	}
+}
+
+func TestValidateOptions(t *testing.T) {
+	cases := []struct {
+		options Options
+		fails   bool
+	}{
+		{Options{}, false},
+		{Options{ImageTag: "myproject", Name: "myproject-dev"}, false},
+		{Options{ImageTag: "registry.example.com/team/app:1.0"}, false},
+		{Options{ImageTag: "MyProject"}, true},
+		{Options{ImageTag: "my project"}, true},
+		{Options{ImageTag: "-app"}, true},
+		{Options{Name: "My.Project_1"}, false},
+		{Options{Name: "_dev"}, true},
+		{Options{Name: "dev/1"}, true},
+	}
+
+	for _, c := range cases {
+		if err := c.options.Validate(); (err != nil) != c.fails {
+			t.Errorf("Expected error of %+v to be %v, got %v", c.options, c.fails, err)
+		}
+	}
+}
+
+func TestImageTag(t *testing.T) {
+	cases := []struct {
+		name     string
+		expected string
+	}{
+		{"Go", "go_code_coder_server"},
+		{"My Project", "my_project_code_coder_server"},
+		{"node.js-app", "node.js-app_code_coder_server"},
+		{"team/app:latest", "team_app_latest_code_coder_server"},
+		{".hidden", "hidden_code_coder_server"},
+		{"a -- b", "a_b_code_coder_server"},
+		{"Café ☕", "caf_code_coder_server"},
+		{"日本語", "77710aed_code_coder_server"},
+		{strings.Repeat("a", 200), strings.Repeat("a", 128) + "_code_coder_server"},
+	}
+
+	for _, c := range cases {
+		devcontainer := DevContainer{Name: c.name}
+		tag := getImageTag(devcontainer, Options{})
+		if tag != c.expected {
+			t.Errorf("Expected image tag of %s to be %s, got %s", c.name, c.expected, tag)
+		}
+		if !imageTagPattern.MatchString(tag) {
+			t.Errorf("Expected image tag of %s to be valid, got %s", c.name, tag)
+		}
+	}
+}
+
+func TestSELinuxLabel(t *testing.T) {
+	enforcing := func() bool { return true }
+	permissive := func() bool { return false }
+	if label := getSELinuxLabel(Options{}, enforcing); label != "z" {
+		t.Errorf("Expected SELinux label to be z when SELinux is enforcing, got %s", label)
+	}
+	if label := getSELinuxLabel(Options{}, permissive); label != "" {
+		t.Errorf("Expected no SELinux label when SELinux is not enforcing, got %s", label)
+	}
+	if label := getSELinuxLabel(Options{SELinuxLabel: "none"}, enforcing); label != "" {
+		t.Errorf("Expected no SELinux label with none, got %s", label)
+	}
+	if options := (Options{SELinuxLabel: "shared"}); options.Validate() == nil {
+		t.Errorf("Expected an error for SELinux label shared")
+	}
+
+	cases := []struct {
+		mount    string
+		label    string
+		expected []string
+	}{
+		{"source=/src,target=/workspace/src,type=bind", "", []string{"--mount", "source=/src,target=/workspace/src,type=bind"}},
+		{"source=/src,target=/workspace/src,type=bind", "z", []string{"-v", "/src:/workspace/src:z"}},
+		{"src=/src,dst=/workspace/src,type=bind,consistency=cached,readonly", "Z", []string{"-v", "/src:/workspace/src:cached,ro,Z"}},
+		{"source=vol,target=/data,type=volume", "z", []string{"--mount", "source=vol,target=/data,type=volume"}},
+	}
+	for _, c := range cases {
+		args, err := getMountArgs(c.mount, c.label)
+		if err != nil {
+			t.Errorf("Error getting mount args of %s: %s", c.mount, err)
+		}
+		if !reflect.DeepEqual(args, c.expected) {
+			t.Errorf("Expected mount args of %s with %s to be %v, got %v", c.mount, c.label, c.expected, args)
+		}
+	}
+	if _, err := getMountArgs("source=/src,target=/src,type=bind,bind-nonrecursive=true", "z"); err == nil {
+		t.Errorf("Expected an error for a mount option which cannot be given with -v")
+	}
+}
+
+func TestBuildRunArgs(t *testing.T) {
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project"}
+	devcontainer.ForwardPorts = []string{"3000"}
+	devcontainer.Mounts = []string{"source=/var/run/docker.sock,target=/var/run/docker.sock,type=bind"}
+	devcontainer.RunArgs = []string{"--cap-add=SYS_PTRACE"}
+	devcontainer.RemoteUser = "vscode"
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+	// the mounts are relabeled on hosts enforcing SELinux
+	options := Options{Name: "dev", ExtraRunArgs: []string{"--privileged"}, SELinuxLabel: "none"}
+
+	args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, options)
+	if err != nil {
+		t.Fatalf("Error building run args: %s", err)
+	}
+
+	expected := []string{
+		"run", "--rm", "--name", "dev",
+		"--label", InstanceLabel,
+		"--label", "code-code-server.name=project",
+		"--label", "code-code-server.version=" + Version,
+		"-p", "0.0.0.0:58818:8080",
+		"--mount", "source=/home/user/project,target=/workspace/project,type=bind",
+		"--mount", "source=/var/run/docker.sock,target=/var/run/docker.sock,type=bind",
+		"-w", "/workspace/project",
+		"--cap-add=SYS_PTRACE",
+		"--privileged",
+		"-p", "3000",
+		"-u", "vscode",
+		"project_code_coder_server",
+	}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected run args to be %v, got %v", expected, args)
+	}
+}
+
+func TestBuildRunArgsProbes(t *testing.T) {
+	overrideCommand := false
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project", OverrideCommand: &overrideCommand}
+	devcontainer.HostRequirements.Gpu = GpuRequirement{Required: true}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+	options := Options{Name: "dev", Network: "backend"}
+	probes := hostProbes{
+		validateNetwork:  func(network string) error { return nil },
+		nvidiaAvailable:  func() bool { return true },
+		imageCommand:     func(tag string) ([]string, error) { return []string{"/docker-entrypoint.sh", "serve"}, nil },
+		selinuxEnforcing: func() bool { return false },
+		rootlessPodman:   func() bool { return true },
+	}
+
+	args, err := buildRunArgs("project_code_coder_server", devcontainer, serviceURL, options, probes)
+	if err != nil {
+		t.Fatalf("Error building run args: %s", err)
+	}
+	joined := strings.Join(args, " ")
+	for _, v := range []string{"--network backend", "--gpus all", "--entrypoint " + EntryScript + " project_code_coder_server /docker-entrypoint.sh serve"} {
+		if !strings.Contains(joined, v) {
+			t.Errorf("Expected run args to contain %s, got %v", v, args)
+		}
+	}
+
+	probes.validateNetwork = func(network string) error { return fmt.Errorf("Docker network %s does not exist", network) }
+	if _, err := buildRunArgs("project_code_coder_server", devcontainer, serviceURL, options, probes); err == nil {
+		t.Errorf("Expected an error for a missing network")
+	}
+	probes.validateNetwork = func(network string) error { return nil }
+	probes.nvidiaAvailable = func() bool { return false }
+	if _, err := buildRunArgs("project_code_coder_server", devcontainer, serviceURL, options, probes); err == nil {
+		t.Errorf("Expected an error for a required GPU without the NVIDIA runtime")
+	}
+}
+
+func TestPersist(t *testing.T) {
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project"}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+	options := Options{Name: "dev", Persist: true, SELinuxLabel: "none", WrapOptions: WrapOptions{UserDataDir: "/data/code-server"}}
+	args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, options)
+	if err != nil {
+		t.Fatalf("Error building run args: %s", err)
+	}
+
+	// settings.json and extensions of the image must not be hidden by the volumes
+	volume := getUserDataVolume(devcontainer)
+	joined := strings.Join(args, " ")
+	for _, v := range []string{
+		"--mount source=" + volume + "-globalstorage,target=/data/code-server/User/globalStorage,type=volume",
+		"--mount source=" + volume + "-workspacestorage,target=/data/code-server/User/workspaceStorage,type=volume",
+	} {
+		if !strings.Contains(joined, v) {
+			t.Errorf("Expected run args to contain %s, got %v", v, args)
+		}
+	}
+	if strings.Contains(joined, "target=/data/code-server,") {
+		t.Errorf("Expected the user data dir not to be mounted as a whole, got %v", args)
+	}
+}
+
+func TestHostNetworkBindAddr(t *testing.T) {
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project", RunArgs: []string{"--network=host"}}
+	options := Options{Name: "dev", BindAddr: "127.0.0.1", SELinuxLabel: "none"}
+	serviceURL, err := GetServiceURL(devcontainer, options)
+	if err != nil {
+		t.Fatalf("Error getting service URL: %s", err)
+	}
+
+	args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, options)
+	if err != nil {
+		t.Fatalf("Error building run args: %s", err)
+	}
+	// the port is not published, and two instances listen on their own ports of the host
+	joined := strings.Join(args, " ")
+	expected := fmt.Sprintf("-e %s=127.0.0.1:%d", BindAddrEnv, serviceURL.Port)
+	if !strings.Contains(joined, expected) || strings.Contains(joined, " -p ") {
+		t.Errorf("Expected run args to contain %s without publishing a port, got %v", expected, args)
+	}
+}
+
+func TestKeepRunArgs(t *testing.T) {
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project"}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+	for _, keep := range []bool{false, true} {
+		options := Options{Name: "dev", Keep: keep, SELinuxLabel: "none"}
+		args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, options)
+		if err != nil {
+			t.Fatalf("Error building run args: %s", err)
+		}
+		if removed := args[1] == "--rm"; removed == keep {
+			t.Errorf("Expected --rm to be given %v with keep %v, got %v", !keep, keep, args)
+		}
+	}
+}
+
+func TestNoWorkspaceMount(t *testing.T) {
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project"}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project/docs"}
+	cases := []struct {
+		options  Options
+		mount    string
+		expected string
+	}{
+		{Options{}, "source=/home/user/project,target=/workspace/project,type=bind", "/workspace/project/docs"},
+		{Options{NoWorkspaceMount: true}, "", "/workspace/project/docs"},
+		{Options{NoWorkspaceMount: true, WrapOptions: WrapOptions{CloneRepository: "https://github.com/ar90n/code-code-server"}}, "source=" + getWorkspaceVolume(devcontainer) + ",target=/workspace/project,type=volume", "/workspace/project"},
+	}
+	for _, c := range cases {
+		c.options.Name = "dev"
+		c.options.SELinuxLabel = "none"
+		args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, c.options)
+		if err != nil {
+			t.Fatalf("Error building run args: %s", err)
+		}
+		mount, workdir := "", ""
+		for i := 0; i+1 < len(args); i++ {
+			switch args[i] {
+			case "--mount":
+				mount = args[i+1]
+			case "-w":
+				workdir = args[i+1]
+			}
+		}
+		if mount != c.mount || workdir != c.expected {
+			t.Errorf("Expected the workspace to be mounted by %q in %s, got %q in %s", c.mount, c.expected, mount, workdir)
+		}
+	}
+
+	options := Options{WrapOptions: WrapOptions{CloneRepository: "https://github.com/ar90n/code-code-server"}}
+	if err := options.Validate(); err == nil {
+		t.Errorf("Expected an error for cloning into the mounted workspace")
+	}
+}
+
+func TestShutdownAction(t *testing.T) {
+	cases := []struct {
+		shutdownAction string
+		valid          bool
+	}{
+		{"", true},
+		{"none", true},
+		{"stopContainer", true},
+		{"stopCompose", false},
+		{"kill", false},
+	}
+	for _, c := range cases {
+		devcontainer := DevContainer{ShutdownAction: c.shutdownAction}
+		if err := validateShutdownAction(devcontainer.GetShutdownAction()); (err == nil) != c.valid {
+			t.Errorf("Expected shutdownAction %s to be valid: %v, got %v", c.shutdownAction, c.valid, err)
+		}
+	}
+
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project", ShutdownAction: "none"}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+	args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, Options{Name: "dev"})
+	if err != nil {
+		t.Fatalf("Error building run args: %s", err)
+	}
+	if !strings.Contains(strings.Join(args, " "), "--sig-proxy=false") {
+		t.Errorf("Expected run args to disable the signal proxy with shutdownAction none, got %v", args)
+	}
+}
+
+func TestHostRequirements(t *testing.T) {
+	requirements := HostRequirements{Cpus: 4, Memory: "8gb", Storage: "32gb"}
+	cases := []struct {
+		ncpu     int
+		memTotal int64
+		fails    bool
+	}{
+		{8, 16 << 30, false},
+		{4, 8 << 30, false},
+		// docker reports the total memory of an 8gb host a little below 8gb
+		{4, 7900 << 20, false},
+		{2, 16 << 30, true},
+		{8, 4 << 30, true},
+		{8, 7 << 30, true},
+	}
+	for _, c := range cases {
+		if err := checkHostRequirements(requirements, c.ncpu, c.memTotal); (err != nil) != c.fails {
+			t.Errorf("Expected error with %d CPUs and %d bytes to be %v, got %v", c.ncpu, c.memTotal, c.fails, err)
+		}
+	}
+
+	if _, err := parseMemorySize("lots"); err == nil {
+		t.Errorf("Expected an error when the size is invalid")
+	}
+	if size, _ := parseMemorySize("512MB"); size != 512<<20 {
+		t.Errorf("Expected 512MB to be %d bytes, got %d", 512<<20, size)
+	}
+}
+
+func TestSecretArgs(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "npmrc")
+	if err := os.WriteFile(src, []byte("token"), 0600); err != nil {
+		t.Fatalf("Error writing the secret: %s", err)
+	}
+
+	args, err := getSecretArgs([]string{"id=npm,source=" + src})
+	if err != nil {
+		t.Fatalf("Error getting secret args: %s", err)
+	}
+	expected := []string{"--secret", "id=npm,src=" + src}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Expected secret args to be %v, got %v", expected, args)
+	}
+
+	invalids := []string{
+		"id=npm",
+		"src=" + src,
+		"npm",
+		"id=npm,src=" + src + ",mode=0400",
+		"id=npm,src=" + filepath.Join(dir, "missing"),
+		"id=npm,src=" + dir,
+	}
+	for _, secret := range invalids {
+		if _, err := getSecretArgs([]string{secret}); err == nil {
+			t.Errorf("Expected an error for secret %s", secret)
+		}
+	}
+
+	options := Options{Secrets: []string{"id=npm,src=" + src}, NoBuildKit: true}
+	if err := options.Validate(); err == nil {
+		t.Errorf("Expected an error when secrets are used without BuildKit")
+	}
+	if env, _ := getBuildKitEnv("FROM ubuntu", Options{Secrets: options.Secrets}); env != "DOCKER_BUILDKIT=1" {
+		t.Errorf("Expected secrets to enable BuildKit, got %s", env)
+	}
+}
+
+func TestChooseContainer(t *testing.T) {
+	cases := []struct {
+		named    []string
+		labeled  []string
+		expected string
+		fails    bool
+	}{
+		{[]string{"go"}, []string{"go-1", "go-2"}, "go", false},
+		{[]string{"go-1"}, []string{"go-1"}, "go-1", false},
+		{[]string{}, []string{"go-1"}, "go-1", false},
+		{[]string{}, []string{"go-1", "go-2"}, "", true},
+		{[]string{}, []string{}, "", true},
+	}
+	for _, c := range cases {
+		name, err := chooseContainer("go", c.named, c.labeled)
+		if (err != nil) != c.fails {
+			t.Errorf("Expected error for %v and %v to be %v, got %v", c.named, c.labeled, c.fails, err)
+		}
+		if name != c.expected {
+			t.Errorf("Expected container to be %s, got %s", c.expected, name)
+		}
+	}
+}
+
+// TestHelperProcess is run by fakeExecCommand in place of docker. It consumes stdin, prints
+// GO_HELPER_OUTPUT and exits successfully.
+func TestHelperProcess(t *testing.T) {
+	if os.Getenv("GO_WANT_HELPER_PROCESS") != "1" {
+		return
+	}
+	io.Copy(ioutil.Discard, os.Stdin)
+	fmt.Print(os.Getenv("GO_HELPER_OUTPUT"))
+	os.Exit(0)
+}
+
+// fakeExecCommand replaces execCommand and execCommandContext with ones which record the commands
+// and run TestHelperProcess instead.
+func fakeExecCommand(t *testing.T) *[][]string {
+	return fakeExecCommandOutput(t, func(command []string) string { return "" })
+}
+
+// fakeExecCommandOutput is fakeExecCommand whose commands print the output for them.
+func fakeExecCommandOutput(t *testing.T, output func(command []string) string) *[][]string {
+	commands := [][]string{}
+	helper := func(ctx context.Context, name string, args ...string) *exec.Cmd {
+		command := append([]string{name}, args...)
+		commands = append(commands, command)
+		cmd := exec.CommandContext(ctx, os.Args[0], "-test.run=TestHelperProcess")
+		cmd.Env = append(os.Environ(), "GO_WANT_HELPER_PROCESS=1", "GO_HELPER_OUTPUT="+output(command))
+		return cmd
+	}
+
+	origExecCommand, origExecCommandContext := execCommand, execCommandContext
+	execCommand = func(name string, args ...string) *exec.Cmd {
+		return helper(context.Background(), name, args...)
+	}
+	execCommandContext = helper
+	t.Cleanup(func() {
+		execCommand, execCommandContext = origExecCommand, origExecCommandContext
+	})
+	return &commands
+}
+
+func TestListExtensions(t *testing.T) {
+	// stdin is not a terminal, so docker exec is not given -t
+	stdinPath := filepath.Join(t.TempDir(), "stdin")
+	if err := ioutil.WriteFile(stdinPath, nil, 0644); err != nil {
+		t.Fatalf("Error writing stdin: %s", err)
+	}
+	stdin, err := os.Open(stdinPath)
+	if err != nil {
+		t.Fatalf("Error opening stdin: %s", err)
+	}
+	defer stdin.Close()
+	origStdin := os.Stdin
+	os.Stdin = stdin
+	t.Cleanup(func() { os.Stdin = origStdin })
+
+	cases := []struct {
+		options       WrapOptions
+		extensionsDir string
+	}{
+		{WrapOptions{}, "/opt/code-server/.vscode/extensions/"},
+		{WrapOptions{ExtensionsDir: "/home/vscode/.vscode-server/extensions"}, "/home/vscode/.vscode-server/extensions"},
+	}
+	for _, c := range cases {
+		commands := fakeExecCommandOutput(t, func(command []string) string {
+			// the project go has a single container go-1
+			if strings.Contains(strings.Join(command, " "), "--filter label="+NameLabel+"=go ") {
+				return "go-1\n"
+			}
+			return ""
+		})
+
+		if err := ListExtensions("go", c.options); err != nil {
+			t.Fatalf("Error listing extensions: %s", err)
+		}
+		expected := []string{EngineBinary(), "exec", "-i", "go-1", "code-server", "--list-extensions", "--show-versions", "--extensions-dir", c.extensionsDir}
+		if last := (*commands)[len(*commands)-1]; !reflect.DeepEqual(last, expected) {
+			t.Errorf("Expected command to be %v, got %v", expected, last)
+		}
+	}
+}
+
+func TestBuildImageCommand(t *testing.T) {
+	commands := fakeExecCommand(t)
+	for _, k := range proxyVariables {
+		t.Setenv(k, "")
+	}
+
+	dirPath := filepath.Join(t.TempDir(), ".devcontainer")
+	if err := os.Mkdir(dirPath, 0755); err != nil {
+		t.Fatalf("Error creating .devcontainer: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dirPath, "Dockerfile"), []byte("FROM ubuntu\n"), 0644); err != nil {
+		t.Fatalf("Error writing Dockerfile: %s", err)
+	}
+	devcontainer := DevContainer{DirPath: dirPath, Name: "project"}
+	devcontainer.Build.Dockerfile = "Dockerfile"
+	devcontainer.Build.Args = map[string]string{"VERSION": "1.0"}
+
+	tag, err := BuildImage(context.Background(), devcontainer, emptyRepository{}, Options{Quiet: true})
+	if err != nil {
+		t.Fatalf("Error building image: %s", err)
+	}
+	if tag != "project_code_coder_server" {
+		t.Errorf("Expected tag to be project_code_coder_server, got %s", tag)
+	}
+
+	expected := [][]string{{
+		"docker", "build", "-t", "project_code_coder_server", "-f", ".code-code-server/Dockerfile",
+		"--label", InstanceLabel,
+		"--label", "code-code-server.name=project",
+		"--label", "code-code-server.version=" + Version,
+		"--build-arg", "VERSION=1.0",
+		"-",
+	}}
+	if !reflect.DeepEqual(*commands, expected) {
+		t.Errorf("Expected commands to be %v, got %v", expected, *commands)
+	}
+}
+
+func TestNewContainerContextCommand(t *testing.T) {
+	commands := fakeExecCommand(t)
+
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project"}
+	devcontainer.RunArgs = []string{"--cap-add=SYS_PTRACE"}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+
+	ctx, err := NewContainerContext("project_code_coder_server", devcontainer, serviceURL, Options{Name: "dev", SELinuxLabel: "none"})
+	if err != nil {
+		t.Fatalf("Error creating container context: %s", err)
+	}
+	if ctx.Name() != "dev" {
+		t.Errorf("Expected container name to be dev, got %s", ctx.Name())
+	}
+
+	expected := [][]string{{
+		"docker", "run", "--rm", "--name", "dev",
+		"--label", InstanceLabel,
+		"--label", "code-code-server.name=project",
+		"--label", "code-code-server.version=" + Version,
+		"-p", "0.0.0.0:58818:8080",
+		"--mount", "source=/home/user/project,target=/workspace/project,type=bind",
+		"-w", "/workspace/project",
+		"--cap-add=SYS_PTRACE",
+		"project_code_coder_server",
+	}}
+	if !reflect.DeepEqual(*commands, expected) {
+		t.Errorf("Expected commands to be %v, got %v", expected, *commands)
+	}
+}
+
+func TestStopContainer(t *testing.T) {
+	commands := fakeExecCommandOutput(t, func(command []string) string {
+		switch strings.Join(command[1:], " ") {
+		// the project go has a single container go-1 with a sidecar and its network
+		case "ps --filter label=" + InstanceLabel + " --filter label=" + NameLabel + "=go --format {{.Names}}":
+			return "go-1\n"
+		case "ps -q --filter label=" + OwnerLabel + "=go-1":
+			return "0123456789ab\n"
+		case "network ls -q --filter label=" + OwnerLabel + "=go-1":
+			return "ba9876543210\n"
+		}
+		return ""
+	})
+
+	if err := StopContainer("go", 10*time.Second); err != nil {
+		t.Fatalf("Error stopping container: %s", err)
+	}
+	expected := [][]string{
+		{"docker", "ps", "--filter", "label=" + InstanceLabel, "--filter", "name=go", "--format", "{{.Names}}"},
+		{"docker", "ps", "--filter", "label=" + InstanceLabel, "--filter", "label=" + NameLabel + "=go", "--format", "{{.Names}}"},
+		{"docker", "stop", "-t", "10", "go-1"},
+		{"docker", "ps", "-q", "--filter", "label=" + OwnerLabel + "=go-1"},
+		{"docker", "stop", "0123456789ab"},
+		{"docker", "network", "ls", "-q", "--filter", "label=" + OwnerLabel + "=go-1"},
+		{"docker", "network", "rm", "ba9876543210"},
+	}
+	if !reflect.DeepEqual(*commands, expected) {
+		t.Errorf("Expected commands to be %v, got %v", expected, *commands)
+	}
+
+	if err := StopContainer("rust", 10*time.Second); err == nil {
+		t.Errorf("Expected an error for a project without a running container")
+	}
+}
+
+func TestRemoveImage(t *testing.T) {
+	commands := fakeExecCommand(t)
+
+	if err := RemoveImage("code-code-server-project"); err != nil {
+		t.Fatalf("Error removing image: %s", err)
+	}
+	expected := [][]string{
+		{"docker", "ps", "-a", "-q", "--filter", "ancestor=code-code-server-project"},
+		{"docker", "rmi", "code-code-server-project"},
+	}
+	if !reflect.DeepEqual(*commands, expected) {
+		t.Errorf("Expected commands to be %v, got %v", expected, *commands)
+	}
+}
+
+func TestEngineBinary(t *testing.T) {
+	commands := fakeExecCommand(t)
+	defer SetEngineBinary("")
+
+	SetEngineBinary("/usr/bin/docker.io")
+	if err := killContainer("project"); err != nil {
+		t.Fatalf("Error killing container: %s", err)
+	}
+	expected := [][]string{{"/usr/bin/docker.io", "kill", "project"}}
+	if !reflect.DeepEqual(*commands, expected) {
+		t.Errorf("Expected commands to be %v, got %v", expected, *commands)
+	}
+}
+
+func TestSetEngine(t *testing.T) {
+	origEngine, origLookPath := engine, lookPath
+	defer func() {
+		engine, lookPath = origEngine, origLookPath
+	}()
+
+	cases := []struct {
+		name      string
+		installed []string
+		expected  string
+	}{
+		{"", []string{"docker", "podman"}, Docker},
+		{"", []string{"podman"}, Podman},
+		{"", []string{}, Docker},
+		{"podman", []string{"docker"}, Podman},
+	}
+	for _, c := range cases {
+		installed := c.installed
+		lookPath = func(file string) (string, error) {
+			for _, v := range installed {
+				if v == file {
+					return "/usr/bin/" + file, nil
+				}
+			}
+			return "", exec.ErrNotFound
+		}
+		if err := SetEngine(c.name); err != nil {
+			t.Errorf("Error setting engine %s: %s", c.name, err)
+		}
+		if Engine() != c.expected {
+			t.Errorf("Expected engine %q with %v installed to be %s, got %s", c.name, c.installed, c.expected, Engine())
+		}
+	}
+
+	if err := SetEngine("containerd"); err == nil {
+		t.Errorf("Expected an error for an unknown engine")
+	}
+
+	// rootful podman rejects --userns=keep-id
+	engine = Podman
+	devcontainer := DevContainer{DirPath: "/home/user/project/.devcontainer", Name: "project"}
+	serviceURL := ServiceURL{Host: "localhost", Port: 58818, WorkspaceFolder: "/workspace/project"}
+	for _, rootless := range []bool{true, false} {
+		commands := fakeExecCommandOutput(t, func(command []string) string { return strconv.FormatBool(rootless) + "\n" })
+		args, err := BuildRunArgs("project_code_coder_server", devcontainer, serviceURL, Options{Name: "dev", SELinuxLabel: "none"})
+		if err != nil {
+			t.Fatalf("Error building run args: %s", err)
+		}
+		if keepID := strings.Contains(strings.Join(args, " "), "--userns=keep-id"); keepID != rootless {
+			t.Errorf("Expected run args to keep the user id on podman with rootless %v: %v, got %v", rootless, rootless, args)
+		}
+		expected := [][]string{{Podman, "info", "--format", "{{.Host.Security.Rootless}}"}}
+		if !reflect.DeepEqual(*commands, expected) {
+			t.Errorf("Expected commands to be %v, got %v", expected, *commands)
+		}
+	}
+}
+
+func TestForwardedPortURL(t *testing.T) {
+	cases := []struct {
+		spec     string
+		out      string
+		expected string
+	}{
+		{"3000", "0.0.0.0:49153\n[::]:49153\n", "http://192.168.1.2:49153"},
+		{"8000:3000", "127.0.0.1:8000\n", "http://192.168.1.2:8000"},
+		{"8000:3000", "", "http://192.168.1.2:8000"},
+		{"127.0.0.1:8000:3000", "", "http://192.168.1.2:8000"},
+		{"3000", "", "http://192.168.1.2:3000"},
+		{"53/udp", "0.0.0.0:49154\n", ""},
+	}
+	for _, c := range cases {
+		commands := fakeExecCommandOutput(t, func(command []string) string { return c.out })
+		port := ForwardedPort{Spec: c.spec, Port: getContainerPort(c.spec)}
+		resolved := ResolveForwardedPorts("dev", []ForwardedPort{port})
+
+		expected := [][]string{{EngineBinary(), "port", "dev", port.Port + "/" + port.protocol()}}
+		if !reflect.DeepEqual(*commands, expected) {
+			t.Errorf("Expected commands to be %v, got %v", expected, *commands)
+		}
+		if url := resolved[0].URL("192.168.1.2"); url != c.expected {
+			t.Errorf("Expected URL of %s published as %q to be %s, got %s", c.spec, c.out, c.expected, url)
+		}
+	}
+}
@@ -2,19 +2,49 @@ package gist
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"log"
+	"net"
+	"net/http"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/google/go-github/v43/github"
 )
 
+// DefaultTimeout bounds each request to GitHub so that a hung request does not stall the build.
+const DefaultTimeout = 30 * time.Second
+
 type GistRepository struct {
-	gistId string
+	gistId  string
+	client  *github.Client
+	timeout time.Duration
+	cache   *gistCache
+}
+
+// gistCache holds the gist fetched by the first Get, so that all the files are served by a single API call
+// against the rate limit of GitHub.
+type gistCache struct {
+	once sync.Once
+	gist *github.Gist
+	err  error
+}
+
+func (r *GistRepository) fetch(ctx context.Context) (*github.Gist, error) {
+	r.cache.once.Do(func() {
+		r.cache.gist, _, r.cache.err = r.client.Gists.Get(ctx, r.gistId)
+		var netErr net.Error
+		if errors.As(r.cache.err, &netErr) && netErr.Timeout() {
+			log.Printf("Fetching gist %s timed out after %s. Local settings are used instead", r.gistId, r.timeout)
+		}
+	})
+	return r.cache.gist, r.cache.err
 }
 
 func (r *GistRepository) Get(ctx context.Context, filename string) (string, error) {
-	client := github.NewClient(nil)
-	gist, _, err := client.Gists.Get(ctx, r.gistId)
+	gist, err := r.fetch(ctx)
 	if err != nil {
 		return "", err
 	}
@@ -28,17 +58,49 @@ func (r *GistRepository) Get(ctx context.Context, filename string) (string, erro
 }
 
 func New() (GistRepository, error) {
-	gistId := os.Getenv("SETTINGS_SYNC_GIST_ID")
+	return NewWithTimeout(DefaultTimeout)
+}
+
+// NewWithTimeout creates a repository of the gist given by SETTINGS_SYNC_GIST_ID whose requests time out
+// after timeout. A zero timeout means no timeout.
+func NewWithTimeout(timeout time.Duration) (GistRepository, error) {
+	return NewWithDefault("", timeout)
+}
+
+// NewWithDefault is NewWithTimeout which uses defaultGistId, such as settingsSyncGistId in devcontainer.json,
+// when SETTINGS_SYNC_GIST_ID is not set.
+func NewWithDefault(defaultGistId string, timeout time.Duration) (GistRepository, error) {
+	gistId := getSettingsSyncGistId(defaultGistId)
 	if gistId == "" {
 		return GistRepository{}, fmt.Errorf("SETTINGS_SYNC_GIST_ID is not set")
 	}
 
-	return NewWithGistID(gistId)
+	return NewWithClient(gistId, github.NewClient(&http.Client{Timeout: timeout}))
+}
+
+// getSettingsSyncGistId returns SETTINGS_SYNC_GIST_ID so that users can override the gist of the project.
+func getSettingsSyncGistId(defaultGistId string) string {
+	if gistId := os.Getenv("SETTINGS_SYNC_GIST_ID"); gistId != "" {
+		return gistId
+	}
+	return defaultGistId
 }
 
 func NewWithGistID(gistId string) (GistRepository, error) {
+	return NewWithClient(gistId, github.NewClient(&http.Client{Timeout: DefaultTimeout}))
+}
+
+// NewWithClient creates a repository which fetches the gist through the given client.
+// It allows authenticated clients, GitHub Enterprise and fake servers in tests.
+func NewWithClient(gistId string, client *github.Client) (GistRepository, error) {
 	repository := GistRepository{
 		gistId: gistId,
+		client: client,
+		cache:  &gistCache{},
+	}
+	// the timeout is only for the log as the client enforces it
+	if client.Client() != nil {
+		repository.timeout = client.Client().Timeout
 	}
 	return repository, nil
 }
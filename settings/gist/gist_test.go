@@ -0,0 +1,117 @@
+package gist
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v43/github"
+)
+
+// newTestRepository returns a repository of the gist served by handler.
+func newTestRepository(t *testing.T, gistId string, timeout time.Duration, handler http.HandlerFunc) GistRepository {
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+
+	client := github.NewClient(&http.Client{Timeout: timeout})
+	baseURL, err := url.Parse(server.URL + "/")
+	if err != nil {
+		t.Fatalf("Error parsing the server URL: %s", err)
+	}
+	client.BaseURL = baseURL
+
+	repository, err := NewWithClient(gistId, client)
+	if err != nil {
+		t.Fatalf("Error creating repository: %s", err)
+	}
+	return repository
+}
+
+func TestGetFetchesGistOnce(t *testing.T) {
+	var requests int32
+	repository := newTestRepository(t, "0123", 0, func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		fmt.Fprint(w, `{"id": "0123", "files": {"settings.json": {"content": "{}"}, "keybindings.json": {"content": "[]"}}}`)
+	})
+
+	var wg sync.WaitGroup
+	for _, filename := range []string{"settings.json", "keybindings.json", "keybindingsMac.json"} {
+		wg.Add(1)
+		go func(filename string) {
+			defer wg.Done()
+			repository.Get(context.Background(), filename)
+		}(filename)
+	}
+	wg.Wait()
+
+	if requests != 1 {
+		t.Errorf("Expected the gist to be fetched once, got %d requests", requests)
+	}
+	if contents, err := repository.Get(context.Background(), "keybindings.json"); err != nil || contents != "[]" {
+		t.Errorf("Expected keybindings.json to be [], got %s, %v", contents, err)
+	}
+}
+
+func TestGetMissingFile(t *testing.T) {
+	repository := newTestRepository(t, "0123", 0, func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"id": "0123", "files": {"settings.json": {"content": "{}"}}}`)
+	})
+
+	if _, err := repository.Get(context.Background(), "keybindings.json"); err == nil {
+		t.Errorf("Expected an error for a file missing in the gist")
+	}
+}
+
+func TestGetTimeout(t *testing.T) {
+	repository := newTestRepository(t, "0123", 50*time.Millisecond, func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(500 * time.Millisecond)
+		fmt.Fprint(w, `{"id": "0123", "files": {"settings.json": {"content": "{}"}}}`)
+	})
+
+	start := time.Now()
+	if _, err := repository.Get(context.Background(), "settings.json"); err == nil {
+		t.Errorf("Expected an error for a gist which times out")
+	}
+	if elapsed := time.Since(start); 500*time.Millisecond <= elapsed {
+		t.Errorf("Expected the request to time out before the gist is served, got %s", elapsed)
+	}
+}
+
+func TestSettingsSyncGistId(t *testing.T) {
+	cases := []struct {
+		env           string
+		defaultGistId string
+		expected      string
+	}{
+		{"", "", ""},
+		{"", "0123", "0123"},
+		{"4567", "", "4567"},
+		{"4567", "0123", "4567"},
+	}
+	for _, c := range cases {
+		t.Setenv("SETTINGS_SYNC_GIST_ID", c.env)
+		if gistId := getSettingsSyncGistId(c.defaultGistId); gistId != c.expected {
+			t.Errorf("Expected gist ID to be %q, got %q", c.expected, gistId)
+		}
+
+		repository, err := NewWithDefault(c.defaultGistId, DefaultTimeout)
+		if c.expected == "" {
+			if err == nil {
+				t.Errorf("Expected an error without a gist ID")
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Error creating repository: %s", err)
+		}
+		if repository.gistId != c.expected {
+			t.Errorf("Expected repository of gist %q, got %q", c.expected, repository.gistId)
+		}
+	}
+}
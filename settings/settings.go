@@ -4,6 +4,7 @@ import (
 	"context"
 )
 
+// Repository is a source of synced settings files such as settings.json and keybindings.json.
 type Repository interface {
 	Get(ctx context.Context, filename string) (string, error)
 }
@@ -0,0 +1,98 @@
+package project
+
+import (
+	"fmt"
+	"os"
+	"strings"
+)
+
+type sidecar struct {
+	alias string
+	image string
+}
+
+// parseSidecar parses an image such as postgres:14 or an aliased one such as db=postgres:14.
+// Without an alias the image name without registry, path and tag is used.
+func parseSidecar(value string) (sidecar, error) {
+	if alias := strings.SplitN(value, "=", 2); len(alias) == 2 {
+		if alias[0] == "" || alias[1] == "" {
+			return sidecar{}, fmt.Errorf("Invalid sidecar %s", value)
+		}
+		return sidecar{alias: alias[0], image: alias[1]}, nil
+	}
+
+	name := value
+	if i := strings.LastIndex(name, "/"); 0 <= i {
+		name = name[i+1:]
+	}
+	name = strings.SplitN(strings.SplitN(name, "@", 2)[0], ":", 2)[0]
+	if name == "" {
+		return sidecar{}, fmt.Errorf("Invalid sidecar %s", value)
+	}
+	return sidecar{alias: name, image: value}, nil
+}
+
+func (s *sidecar) containerName(owner string) string {
+	return fmt.Sprintf("%s-%s", owner, s.alias)
+}
+
+// ownerLabel labels the sidecars and the network of the container so that they are found by StopContainer.
+func (c *ContainerContext) ownerLabel() string {
+	return fmt.Sprintf("%s=%s", OwnerLabel, c.name)
+}
+
+func (c *ContainerContext) startSidecars() error {
+	if len(c.sidecars) == 0 {
+		return nil
+	}
+
+	if c.createNetwork {
+		cmd := execCommand(EngineBinary(), "network", "create", "--label", InstanceLabel, "--label", c.ownerLabel(), c.network)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
+
+	for _, s := range c.sidecars {
+		args := []string{"run", "-d", "--rm", "--name", s.containerName(c.name), "--label", InstanceLabel, "--label", c.ownerLabel()}
+		args = append(args, "--network", c.network, "--network-alias", s.alias, s.image)
+		cmd := execCommand(EngineBinary(), args...)
+		cmd.Stderr = os.Stderr
+		if err := cmd.Run(); err != nil {
+			c.stopSidecars()
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *ContainerContext) stopSidecars() {
+	if len(c.sidecars) == 0 {
+		return
+	}
+
+	for _, s := range c.sidecars {
+		// the sidecar may not have been started, so errors are ignored
+		execCommand(EngineBinary(), "stop", s.containerName(c.name)).Run()
+	}
+	if c.createNetwork {
+		execCommand(EngineBinary(), "network", "rm", c.network).Run()
+	}
+}
+
+// stopOwnedSidecars stops the sidecars of the container and removes their network, which are found by
+// their labels as they were started by another process. Errors are ignored as in stopSidecars.
+func stopOwnedSidecars(owner string) {
+	filter := fmt.Sprintf("label=%s=%s", OwnerLabel, owner)
+	if out, err := execCommand(EngineBinary(), "ps", "-q", "--filter", filter).Output(); err == nil {
+		for _, id := range strings.Fields(string(out)) {
+			execCommand(EngineBinary(), "stop", id).Run()
+		}
+	}
+	if out, err := execCommand(EngineBinary(), "network", "ls", "-q", "--filter", filter).Output(); err == nil {
+		for _, id := range strings.Fields(string(out)) {
+			execCommand(EngineBinary(), "network", "rm", id).Run()
+		}
+	}
+}
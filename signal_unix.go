@@ -0,0 +1,12 @@
+//go:build !windows
+// +build !windows
+
+package project
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals are the signals that stop the container.
+var shutdownSignals = []os.Signal{syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM, syscall.SIGQUIT}
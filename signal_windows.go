@@ -0,0 +1,13 @@
+//go:build windows
+// +build windows
+
+package project
+
+import (
+	"os"
+	"syscall"
+)
+
+// shutdownSignals are the signals that stop the container. Windows has no SIGHUP or SIGQUIT. Go delivers
+// Ctrl-C and Ctrl-Break as os.Interrupt and closing the console as SIGTERM.
+var shutdownSignals = []os.Signal{os.Interrupt, syscall.SIGTERM}